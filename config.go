@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/thraxil/statsd-go/statsd"
+)
+
+// readConfig reads a JSON config file whose keys mirror the command line
+// flags, for example {"graphite": "localhost:2003", "flush-interval": 10}.
+// Values are returned as strings suitable for setFlag; arrays, for
+// repeatable flags, have their elements joined by newlines.
+func readConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values map[string]interface{}
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	settings := make(map[string]string)
+	for name, value := range values {
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if list, ok := value.([]interface{}); ok {
+			var items []string
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+			settings[name] = strings.Join(items, "\n")
+		} else {
+			settings[name] = fmt.Sprint(value)
+		}
+	}
+	return settings, nil
+}
+
+// listFlag is implemented by repeatable flags. Each use on the command line
+// adds newline separated values, but the config file replaces them all.
+type listFlag interface {
+	flag.Value
+	Reset()
+}
+
+// setFlag sets a flag to a value from the config file.
+func setFlag(name, value string) error {
+	if list, ok := flag.Lookup(name).Value.(listFlag); ok {
+		list.Reset()
+	}
+	return flag.Set(name, value)
+}
+
+// commandLineFlags holds the names of the flags given on the command line,
+// which take precedence over the config file. It has to be recorded before
+// the config is applied, since flag.Set marks flags as set too.
+var commandLineFlags = make(map[string]bool)
+
+// loadConfig applies a config file at startup.
+func loadConfig(path string) error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	settings, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range settings {
+		if commandLineFlags[name] {
+			continue
+		}
+		if err := setFlag(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %s", path, name, err.Error())
+		}
+	}
+	return nil
+}
+
+// reloadConfig re-reads the config file and hands the resulting settings
+// to the server, which applies those that can be changed live. If the new
+// settings are invalid the previous ones are kept.
+func reloadConfig(server *statsd.Server, path string) error {
+	settings, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	previous := make(map[string]string)
+	for name, value := range settings {
+		current := flag.Lookup(name).Value.String()
+		if commandLineFlags[name] || current == value {
+			continue
+		}
+		previous[name] = current
+		if err = setFlag(name, value); err != nil {
+			err = fmt.Errorf("%s: %s: %s", path, name, err.Error())
+			break
+		}
+	}
+	if err == nil {
+		var config statsd.Config
+		if config, err = configFromFlags(); err == nil {
+			err = server.Reload(config)
+		}
+	}
+	if err != nil {
+		for name, value := range previous {
+			setFlag(name, value)
+		}
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging configures the log format. Debug output is logged with slog
+// at debug level, so is only shown when debug is set. In JSON mode lines
+// written with the log package are logged at info level.
+func setupLogging(format string, debug bool) error {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	switch format {
+	case "text":
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				switch {
+				case len(groups) > 0:
+				case a.Key == slog.TimeKey:
+					a.Key = "ts"
+				case a.Key == slog.LevelKey:
+					a.Value = slog.StringValue(strings.ToLower(a.Value.String()))
+				}
+				return a
+			},
+		})
+		slog.SetDefault(slog.New(handler))
+	default:
+		return fmt.Errorf("invalid -log-format %q, must be text or json", format)
+	}
+	return nil
+}
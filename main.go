@@ -1,235 +1,377 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"os"
+	"os/signal"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
-)
 
-const (
-	TCP = "tcp"
-	UDP = "udp"
+	"github.com/thraxil/statsd-go/statsd"
 )
 
-type Packet struct {
-	Bucket   string
-	Value    string
-	Modifier string
-	Sampling float32
+var defaults = statsd.DefaultConfig()
+
+// renameFlags collects the repeatable -rename flag.
+type renameFlags []statsd.Rename
+
+func (r *renameFlags) String() string {
+	var rules []string
+	for _, rename := range *r {
+		rules = append(rules, rename.Pattern.String()+"="+rename.Replacement)
+	}
+	return strings.Join(rules, "\n")
+}
+
+func (r *renameFlags) Set(value string) error {
+	for _, rule := range strings.Split(value, "\n") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%q is not of the form pattern=replacement", rule)
+		}
+		pattern, err := regexp.Compile(parts[0])
+		if err != nil {
+			return err
+		}
+		*r = append(*r, statsd.Rename{Pattern: pattern, Replacement: parts[1]})
+	}
+	return nil
+}
+
+func (r *renameFlags) Reset() {
+	*r = nil
+}
+
+var renames renameFlags
+
+func init() {
+	flag.Var(&renames, "rename", "Rewrite bucket names matching a regexp, as pattern=replacement, may be repeated (example: '^web[0-9]+\\.(.*)=web.$1')")
 }
 
 var (
-	serviceAddress   = flag.String("address", ":8125", "UDP service address")
-	graphiteAddress  = flag.String("graphite", "", "Graphite service address (example: 'localhost:2003')")
-	flushInterval    = flag.Int64("flush-interval", 10, "Flush interval")
-	percentThreshold = flag.Int("percent-threshold", 90, "Threshold percent")
-	statsPrefix      = flag.String("stats-prefix", "stats.", "Counters Prefix")
-	countersPrefix   = flag.String("counters-prefix", "stats.counters.", "Counters Prefix")
-	gaugesPrefix     = flag.String("gauges-prefix", "stats.gauges.", "Gauges Prefix")
-	timersPrefix     = flag.String("timers-prefix", "stats.timers.", "Timers Prefix")
+	configFile       = flag.String("config", "", "JSON config file whose keys mirror these flags")
+	serviceAddress   = flag.String("address", defaults.Address, "Comma separated UDP service addresses (example: '127.0.0.1:8125,10.0.0.5:8125')")
+	udpNetwork       = flag.String("udp-network", defaults.UDPNetwork, "UDP network to listen on: udp, udp4 or udp6")
+	tcpAddress       = flag.String("tcp-address", "", "TCP service address (example: ':8125')")
+	unixSocket       = flag.String("unix-socket", "", "Unix datagram socket path (example: '/var/run/statsd.sock')")
+	recvBufferSize   = flag.Int("recv-buffer-size", 0, "Kernel receive buffer size in bytes of the UDP and Unix datagram listeners, 0 for the system default")
+	maxPacketSize    = flag.Int("max-udp-packet-size", defaults.MaxPacketSize, "Maximum UDP (and Unix datagram) packet size")
+	sourceRateLimit  = flag.Float64("per-source-rate-limit", 0, "Datagrams per second accepted from each source IP address, 0 for no limit")
+	lowercase        = flag.Bool("lowercase-buckets", false, "Lowercase incoming bucket names so names differing only in case are merged")
+	allowlist        = flag.String("allowlist", "", "Comma separated regexps, metrics whose bucket names match none of them are dropped before -blocklist is applied (example: '^app\\.,^db\\.')")
+	blocklist        = flag.String("blocklist", "", "Comma separated regexps, metrics whose bucket names match any of them are dropped (example: '^django\\.db\\.,\\.debug$')")
+	sourcePrefix     = flag.Bool("source-prefix", false, "Prepend the sender's IP address, with dots replaced, to bucket names")
+	workers          = flag.Int("workers", 0, "Number of goroutines parsing UDP and Unix datagrams, defaults to the number of CPUs")
+	graphiteAddress  = flag.String("graphite", "", "Comma separated Graphite service addresses (example: 'localhost:2003')")
+	graphiteUDP      = flag.Bool("graphite-udp", false, "Send to the -graphite addresses over UDP rather than TCP")
+	graphiteQueue    = flag.Int("graphite-queue-size", 0, "Number of failed flushes kept to retry per Graphite server")
+	graphiteTLS      = flag.Bool("graphite-tls", false, "Connect to Graphite over TLS")
+	graphiteTLSCA    = flag.String("graphite-tls-ca", "", "CA certificate file used to verify Graphite, defaults to the system roots")
+	graphiteTLSCert  = flag.String("graphite-tls-cert", "", "Client certificate file for Graphite TLS")
+	graphiteTLSKey   = flag.String("graphite-tls-key", "", "Client key file for Graphite TLS")
+	pickleAddress    = flag.String("graphite-pickle-address", "", "Graphite pickle protocol service address (example: 'localhost:2004')")
+	stdout           = flag.Bool("stdout", false, "Write each flush to standard output")
+	outputFilePath   = flag.String("output-file", "", "Append each flush to this file")
+	opentsdbAddress  = flag.String("opentsdb-address", "", "OpenTSDB service address (example: 'localhost:4242')")
+	backendSocket    = flag.String("backend-unix-socket", "", "Unix stream socket to write each flush to in the Graphite plaintext protocol (example: '/var/run/collector.sock')")
+	influxdbAddress  = flag.String("influxdb-address", "", "InfluxDB write URL (example: 'http://localhost:8086/write?db=statsd')")
+	flushJitter      = flag.Bool("flush-jitter", false, "Offset flushes by a random fraction of the flush interval, chosen at startup")
+	flushInterval    = flag.Int64("flush-interval", int64(defaults.FlushInterval/time.Second), "Flush interval")
+	flushDuration    = flag.Duration("flush-interval-duration", 0, "Flush interval as a duration, overriding -flush-interval (example: '500ms' or '1m')")
+	stateFile        = flag.String("state-file", "", "Save gauges, counters and timers here on shutdown and restore them on startup")
+	maxFlushBytes    = flag.Int("max-flush-bytes", 0, "Split flushes to Graphite and OpenTSDB into writes of whole lines of at most this many bytes, 0 for no limit")
+	repeatAddress    = flag.String("repeat-address", "", "Comma separated statsd addresses to forward raw metrics to (example: 'statsd1:8125,statsd2:8125')")
+	percentThreshold = flag.Int("percent-threshold", defaults.PercentThreshold, "Threshold percent")
+	percentilesList  = flag.String("percentiles", "", "Comma separated timer percentiles (example: '50,90,95,99'), defaults to -percent-threshold")
+	globalPrefix     = flag.String("global-prefix", "", "Prefix for every series, %HOST% is replaced by the hostname (example: 'hosts.%HOST%.')")
+	globalSuffix     = flag.String("global-suffix", "", "Suffix for every series, %HOST% is replaced by the hostname (example: '.%HOST%')")
+	tagsInPath       = flag.Bool("tags-in-path", false, "Fold tags into Graphite series names as name.value segments, sorted by name, instead of sending Graphite tags")
+	timerUnitScale   = flag.Float64("timer-unit-scale", defaults.TimerUnitScale, "Multiply incoming timer values by this, e.g. 1000 for clients sending seconds")
+	maxTimerSamples  = flag.Int("max-timer-samples", 0, "Keep at most this many random samples per timer each interval, 0 for all; count, sum and sum_squares cover every sample, the other statistics those kept")
+	timerNamespace   = flag.String("timer-namespace", defaults.TimerNamespace, "Timer statistics to send: new for all, or legacy for only mean, upper, lower, count, mean_N and upper_N as sent by the original statsd")
+	timerHistogram   = flag.String("timer-histogram", "", "Comma separated upper bounds of timer histogram bins (example: '10,50,100,500')")
+	statsPrefix      = flag.String("stats-prefix", defaults.StatsPrefix, "Counters Prefix")
+	countersPrefix   = flag.String("counters-prefix", defaults.CountersPrefix, "Counters Prefix")
+	gaugesPrefix     = flag.String("gauges-prefix", defaults.GaugesPrefix, "Gauges Prefix")
+	timersPrefix     = flag.String("timers-prefix", defaults.TimersPrefix, "Timers Prefix")
+	maxBuckets       = flag.Int("max-buckets", 0, "Reject new buckets once this many are being aggregated, 0 for no limit")
+	bucketDelimiter  = flag.String("bucket-delimiter", defaults.BucketDelimiter, "Path delimiter used in incoming bucket names and Graphite series names (example: '/')")
 	debug            = flag.Bool("debug", false, "Debug mode")
-)
+	stdin            = flag.Bool("stdin", false, "Read metrics, one per line, from standard input, then flush and exit once it is closed")
+	check            = flag.Bool("check", false, "Validate the config and test the Graphite connections, then exit")
+	valueFormat      = flag.String("value-format", "%f", "Format of values sent to the text backends, as a Go fmt verb (example: '%g' or '%.2f')")
+	precision        = flag.String("timestamp-precision", "s", "Unit of output timestamps: s, ms or ns")
+	logFormat        = flag.String("log-format", "text", "Log format, text or json")
 
-var (
-	In       = make(chan Packet, 10000)
-	counters = make(map[string]int)
-	timers   = make(map[string][]float64)
-	gauges   = make(map[string]int)
+	deleteIdleStats = flag.Bool("delete-idle-stats", false, "Don't send values for inactive counters, timers, gauges and sets")
+	deleteCounters  = flag.Bool("delete-counters", false, "Don't send values for inactive counters")
+	deleteTimers    = flag.Bool("delete-timers", false, "Don't send values for inactive timers")
+	deleteGauges    = flag.Bool("delete-gauges", false, "Don't send values for inactive gauges")
+	deleteSets      = flag.Bool("delete-sets", false, "Don't send values for inactive sets")
+	counterInterval = flag.Int64("counter-flush-interval", 0, "Counter flush interval, defaults to -flush-interval")
+	timerInterval   = flag.Int64("timer-flush-interval", 0, "Timer flush interval, defaults to -flush-interval")
+	gaugeInterval   = flag.Int64("gauge-flush-interval", 0, "Gauge flush interval, defaults to -flush-interval")
+	gaugeTTL        = flag.Int64("gauge-ttl", 0, "Stop sending gauges which haven't been updated for this many seconds (0 keeps them forever)")
+	enableCounters  = flag.Bool("enable-counters", true, "Accept counters; if false they are dropped as they are parsed")
+	enableTimers    = flag.Bool("enable-timers", true, "Accept timers; if false they are dropped as they are parsed")
+	enableGauges    = flag.Bool("enable-gauges", true, "Accept gauges; if false they are dropped as they are parsed")
+	enableSets      = flag.Bool("enable-sets", true, "Accept sets; if false they are dropped as they are parsed")
+	cumulative      = flag.Bool("counters-cumulative", false, "Send the running total of each counter instead of resetting it every flush")
+	gaugeNoNegative = flag.Bool("gauge-no-negative", false, "Clamp gauges at zero when a delta would take them below it")
+	gaugeSampling   = flag.Bool("sample-gauge-deltas", false, "Scale gauge deltas (+N or -N) by their sample rate, as for counters")
+
+	healthAddress     = flag.String("health-address", "", "Health check HTTP service address (example: ':8127')")
+	adminAddress      = flag.String("admin-address", "", "Admin interface TCP service address (example: 'localhost:8126')")
+	httpIngestAddress = flag.String("http-ingest-address", "", "HTTP service address accepting metrics POSTed to /metrics (example: ':8128')")
+	prometheusAddress = flag.String("prometheus-address", "", "Prometheus metrics HTTP service address (example: ':9102')")
+	debugAddress      = flag.String("debug-address", "", "HTTP service address serving the last Graphite flush at /lastflush and the current state at /state (example: 'localhost:8129')")
 )
 
-func monitor() {
-	var err error
+// configFromFlags builds the server config from the command line flags.
+func configFromFlags() (statsd.Config, error) {
+	percentiles, err := parsePercentiles(*percentilesList)
 	if err != nil {
-		log.Println(err)
+		return statsd.Config{}, fmt.Errorf("invalid -percentiles: %s", err.Error())
 	}
-	t := time.NewTicker(time.Duration(*flushInterval) * time.Second)
-	for {
-		if *debug {
-			log.Println("tick")
-		}
-		select {
-		case <-t.C:
-			submit()
-		case s := <-In:
-			if s.Modifier == "ms" {
-				_, ok := timers[s.Bucket]
-				if !ok {
-					var t []float64
-					timers[s.Bucket] = t
-				}
-				//intValue, _ := strconv.Atoi(s.Value)
-				floatValue, _ := strconv.ParseFloat(s.Value, 64)
-				timers[s.Bucket] = append(timers[s.Bucket], floatValue)
-			} else if s.Modifier == "g" {
-				_, ok := gauges[s.Bucket]
-				if !ok {
-					gauges[s.Bucket] = 0
-				}
-				if strings.HasPrefix(s.Value, "+") {
-					intValue, _ := strconv.Atoi(s.Value[1:])
-					gauges[s.Bucket] += intValue
-				} else if strings.HasPrefix(s.Value, "-") {
-					intValue, _ := strconv.Atoi(s.Value[1:])
-					gauges[s.Bucket] -= intValue
-				} else {
-					intValue, _ := strconv.Atoi(s.Value)
-					gauges[s.Bucket] = intValue
-				}
-			} else {
-				_, ok := counters[s.Bucket]
-				if !ok {
-					counters[s.Bucket] = 0
-				}
-				floatValue, _ := strconv.ParseFloat(s.Value, 32)
-				counters[s.Bucket] += int(float32(floatValue) * (1 / s.Sampling))
-			}
-		}
+	histogram, err := parseHistogram(*timerHistogram)
+	if err != nil {
+		return statsd.Config{}, fmt.Errorf("invalid -timer-histogram: %s", err.Error())
+	}
+	timestampPrecision, err := parsePrecision(*precision)
+	if err != nil {
+		return statsd.Config{}, err
 	}
+	allowed, err := parsePatterns(*allowlist)
+	if err != nil {
+		return statsd.Config{}, fmt.Errorf("invalid -allowlist: %s", err.Error())
+	}
+	blocked, err := parsePatterns(*blocklist)
+	if err != nil {
+		return statsd.Config{}, fmt.Errorf("invalid -blocklist: %s", err.Error())
+	}
+	interval := time.Duration(*flushInterval) * time.Second
+	if *flushDuration != 0 {
+		interval = *flushDuration
+	}
+	return statsd.Config{
+		Address:           *serviceAddress,
+		UDPNetwork:        *udpNetwork,
+		TCPAddress:        *tcpAddress,
+		UnixSocket:        *unixSocket,
+		MaxPacketSize:     *maxPacketSize,
+		RecvBufferSize:    *recvBufferSize,
+		Workers:           *workers,
+		SourcePrefix:      *sourcePrefix,
+		LowercaseBuckets:  *lowercase,
+		GraphiteAddresses: splitList(*graphiteAddress),
+		PickleAddress:     *pickleAddress,
+		GraphiteUDP:       *graphiteUDP,
+		GraphiteQueueSize: *graphiteQueue,
+		GraphiteTLS:       *graphiteTLS,
+		GraphiteTLSCA:     *graphiteTLSCA,
+		GraphiteTLSCert:   *graphiteTLSCert,
+		GraphiteTLSKey:    *graphiteTLSKey,
+		Stdout:            *stdout,
+		OutputFile:        *outputFilePath,
+		OpenTSDBAddress:   *opentsdbAddress,
+		InfluxDBAddress:   *influxdbAddress,
+		BackendUnixSocket: *backendSocket,
+		RepeatAddresses:   splitList(*repeatAddress),
+		MaxFlushBytes:     *maxFlushBytes,
+		StateFile:         *stateFile,
+		FlushInterval:     interval,
+		FlushJitter:       *flushJitter,
+		PercentThreshold:  *percentThreshold,
+		Percentiles:       percentiles,
+		TimerHistogram:    histogram,
+		TimerUnitScale:    *timerUnitScale,
+		MaxTimerSamples:   *maxTimerSamples,
+		TimerNamespace:    *timerNamespace,
+		GlobalPrefix:      *globalPrefix,
+		GlobalSuffix:      *globalSuffix,
+		TagsInPath:        *tagsInPath,
+		Renames:           renames,
+		Allowlist:         allowed,
+		Blocklist:         blocked,
+		SampleGaugeDeltas: *gaugeSampling,
+		GaugeNoNegative:   *gaugeNoNegative,
+		StatsPrefix:       *statsPrefix,
+		CountersPrefix:    *countersPrefix,
+		GaugesPrefix:      *gaugesPrefix,
+		TimersPrefix:      *timersPrefix,
+		BucketDelimiter:   *bucketDelimiter,
+		MaxBuckets:        *maxBuckets,
+		Debug:             *debug,
+		DeleteIdleStats:   *deleteIdleStats,
+		DeleteCounters:    *deleteCounters,
+		DeleteTimers:      *deleteTimers,
+		DeleteGauges:      *deleteGauges,
+		DeleteSets:        *deleteSets,
+		GaugeTTL:          time.Duration(*gaugeTTL) * time.Second,
+		HealthAddress:     *healthAddress,
+		HTTPIngestAddress: *httpIngestAddress,
+		AdminAddress:      *adminAddress,
+		PrometheusAddress: *prometheusAddress,
+		DebugAddress:      *debugAddress,
+
+		CounterFlushInterval: time.Duration(*counterInterval) * time.Second,
+		TimerFlushInterval:   time.Duration(*timerInterval) * time.Second,
+		GaugeFlushInterval:   time.Duration(*gaugeInterval) * time.Second,
+		CountersCumulative:   *cumulative,
+		DisableCounters:      !*enableCounters,
+		DisableTimers:        !*enableTimers,
+		DisableGauges:        !*enableGauges,
+		DisableSets:          !*enableSets,
+		PerSourceRateLimit:   *sourceRateLimit,
+		TimestampPrecision:   timestampPrecision,
+		ValueFormat:          *valueFormat,
+	}, nil
 }
 
-func submit() {
-	var clientGraphite net.Conn
-	if *graphiteAddress != "" {
-		var err error
-		clientGraphite, err = net.Dial(TCP, *graphiteAddress)
-		if clientGraphite != nil {
-			// Run this when we're all done, only if clientGraphite was opened.
-			defer clientGraphite.Close()
-		}
-		if err != nil {
-			log.Printf(err.Error())
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
 		}
 	}
+	return result
+}
 
-	numStats := 0
-	now := int32(time.Now().Unix())
-	buffer := bytes.NewBufferString("")
-	for s, c := range counters {
-		value := float64(c) / float64((float64(*flushInterval)*float64(time.Second))/float64(1e3))
-		fmt.Fprintf(buffer, "%s%s %f %d\n", *statsPrefix, s, value, now)
-		fmt.Fprintf(buffer, "%s%s %d %d\n", *countersPrefix, s, c, now)
-		counters[s] = 0
-		numStats++
-	}
-	for i, g := range gauges {
-		value := int64(g)
-		fmt.Fprintf(buffer, "%s%s %d %d\n", *gaugesPrefix, i, value, now)
-		numStats++
-	}
-	for u, t := range timers {
-		if len(t) > 0 {
-			sort.Float64s(t)
-			min := float64(t[0])
-			max := float64(t[len(t)-1])
-			mean := float64(min)
-			maxAtThreshold := float64(max)
-			count := len(t)
-			if len(t) > 1 {
-				var thresholdIndex int
-				thresholdIndex = ((100 - *percentThreshold) / 100) * count
-				numInThreshold := count - thresholdIndex
-				values := t[0:numInThreshold]
-
-				sum := float64(0)
-				for i := 0; i < numInThreshold; i++ {
-					sum += values[i]
-				}
-				mean = float64(sum) / float64(numInThreshold)
-			}
-			var z []float64
-			timers[u] = z
-
-			fmt.Fprintf(buffer, "%s%s.mean %f %d\n", *timersPrefix, u, mean, now)
-			fmt.Fprintf(buffer, "%s%s.upper %f %d\n", *timersPrefix, u, max, now)
-			fmt.Fprintf(buffer, "%s%s.upper_%d %f %d\n", *timersPrefix, u,
-				*percentThreshold, maxAtThreshold, now)
-			fmt.Fprintf(buffer, "%s%s.lower %f %d\n", *timersPrefix, u, min, now)
-			fmt.Fprintf(buffer, "%s%s.count %d %d\n", *timersPrefix, u, count, now)
-		} else {
-			// Need to still submit timers as zero
-			fmt.Fprintf(buffer, "%s%s.mean %f %d\n", *timersPrefix, u, 0.0, now)
-			fmt.Fprintf(buffer, "%s%s.upper %f %d\n", *timersPrefix, u, 0.0, now)
-			fmt.Fprintf(buffer, "%s%s.upper_%d %f %d\n", *timersPrefix, u,
-				*percentThreshold, 0.0, now)
-			fmt.Fprintf(buffer, "%s%s.lower %f %d\n", *timersPrefix, u, 0.0, now)
-			fmt.Fprintf(buffer, "%s%s.count %d %d\n", *timersPrefix, u, 0, now)
-		}
-		numStats++
+// parsePrecision parses the -timestamp-precision unit.
+func parsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "s":
+		return time.Second, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "ns":
+		return time.Nanosecond, nil
 	}
-	fmt.Fprintf(buffer, "%sstatsd.numStats %d %d\n", *statsPrefix, numStats, now)
-	if clientGraphite != nil {
-		if *debug {
-			log.Println(fmt.Sprintf("Send to graphite: [[[%s]]]\n", string(buffer.Bytes())))
+	return 0, fmt.Errorf("invalid -timestamp-precision %q, must be s, ms or ns", s)
+}
+
+// parsePatterns compiles a comma separated list of regexps.
+func parsePatterns(s string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, p := range splitList(s) {
+		pattern, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
 		}
-		clientGraphite.Write(buffer.Bytes())
+		result = append(result, pattern)
 	}
+	return result, nil
 }
 
-func handleMessage(conn *net.UDPConn, remaddr net.Addr, buf *bytes.Buffer) {
-	var packet Packet
-	var value string
-	var sanitizeRegexp = regexp.MustCompile("[^a-zA-Z0-9\\-_\\.:\\|@]")
-	var packetRegexp = regexp.MustCompile("([a-zA-Z0-9_\\.]+):(\\-?[0-9\\.]+)\\|(c|ms|g)(\\|@([0-9\\.]+))?")
-	s := sanitizeRegexp.ReplaceAllString(buf.String(), "")
-	for _, item := range packetRegexp.FindAllStringSubmatch(s, -1) {
-		value = item[2]
-		if item[3] == "ms" {
-			_, err := strconv.ParseFloat(item[2], 32)
-			if err != nil {
-				value = "0"
-			}
+// parsePercentiles parses a comma separated list of percentiles such as
+// "50,90,95,99".
+func parsePercentiles(s string) ([]int, error) {
+	var result []int
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
 		}
-
-		sampleRate, err := strconv.ParseFloat(item[5], 32)
+		pct, err := strconv.Atoi(p)
 		if err != nil {
-			sampleRate = 1
+			return nil, fmt.Errorf("invalid percentile %q", p)
 		}
+		result = append(result, pct)
+	}
+	return result, nil
+}
 
-		packet.Bucket = item[1]
-		packet.Value = value
-		packet.Modifier = item[3]
-		packet.Sampling = float32(sampleRate)
-
-		if *debug {
-			log.Println(
-				fmt.Sprintf("Packet: bucket = %s, value = %s, modifier = %s, sampling = %f\n",
-					packet.Bucket, packet.Value, packet.Modifier, packet.Sampling))
+// parseHistogram parses a comma separated list of histogram bin upper
+// bounds such as "10,50,100,500".
+func parseHistogram(s string) ([]float64, error) {
+	var result []float64
+	for _, b := range splitList(s) {
+		upper, err := strconv.ParseFloat(b, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bin %q", b)
 		}
-
-		In <- packet
+		result = append(result, upper)
 	}
+	return result, nil
 }
 
-func udpListener() {
-	address, _ := net.ResolveUDPAddr(UDP, *serviceAddress)
-	listener, err := net.ListenUDP(UDP, address)
-	defer listener.Close()
+func main() {
+	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			log.Fatalf("Invalid -config: %s", err.Error())
+		}
+	}
+	if err := setupLogging(*logFormat, *debug); err != nil {
+		log.Fatalln(err)
+	}
+	config, err := configFromFlags()
 	if err != nil {
-		log.Fatalf("ListenAndServe: %s", err.Error())
+		log.Fatalln(err)
 	}
-	for {
-		message := make([]byte, 512)
-		n, remaddr, error := listener.ReadFrom(message)
-		if error != nil {
-			continue
-		}
-		buf := bytes.NewBuffer(message[0:n])
-		if *debug {
-			log.Println("Packet received: " + string(message[0:n]) + "\n")
+	if *check {
+		if err := statsd.Check(config, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Config check failed: %s\n", err.Error())
+			os.Exit(1)
 		}
-		go handleMessage(listener, remaddr, buf)
+		fmt.Println("Config ok")
+		return
+	}
+	server, err := statsd.New(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = server.Start(); err != nil {
+		log.Fatalln(err)
 	}
-}
 
-func main() {
-	flag.Parse()
-	go udpListener()
-	monitor()
+	// stdinDone stays nil, so never ready, unless -stdin is given.
+	var stdinDone chan struct{}
+	if *stdin {
+		stdinDone = make(chan struct{})
+		go func() {
+			if err := server.ReadLines(os.Stdin); err != nil {
+				log.Printf("Reading standard input: %s", err.Error())
+			}
+			close(stdinDone)
+		}()
+	}
+
+	shutdownSignals := make(chan os.Signal, 1)
+	flushSignals := make(chan os.Signal, 1)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(flushSignals, syscall.SIGUSR1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	for {
+		select {
+		case <-flushSignals:
+			log.Println("Received SIGUSR1, flushing")
+			server.Flush()
+		case <-reloadSignals:
+			if *configFile == "" {
+				log.Println("Received SIGHUP but no -config was given, ignoring")
+			} else if err := reloadConfig(server, *configFile); err != nil {
+				log.Printf("Reloading %s: %s", *configFile, err.Error())
+			} else {
+				log.Printf("Reloaded %s", *configFile)
+			}
+		case <-stdinDone:
+			log.Println("Standard input closed, shutting down")
+			server.Stop()
+			return
+		case sig := <-shutdownSignals:
+			log.Printf("Received %s, shutting down", sig)
+			server.Stop()
+			return
+		}
+	}
 }
@@ -0,0 +1,143 @@
+package statsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const adminHelp = `Commands: stats, counters, timers, gauges, sets, delcounters, deltimers, delgauges, delsets, setgraphite, help, quit
+`
+
+func (s *Server) listenAdmin() error {
+	listener, err := net.Listen(TCP, s.config.AdminAddress)
+	if err != nil {
+		return err
+	}
+	s.addListener(listener)
+	go s.acceptLoop(listener, s.handleAdminConnection)
+	return nil
+}
+
+// handleAdminConnection runs admin commands, one per line, until the client
+// quits or disconnects.
+func (s *Server) handleAdminConnection(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			return
+		}
+		var reply string
+		s.withState(func() {
+			reply = s.adminCommand(fields[0], fields[1:])
+		})
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// adminCommand runs a single admin command and returns its output. It must
+// only be called from the monitor() goroutine, see withState.
+func (s *Server) adminCommand(command string, args []string) string {
+	switch command {
+	case "help":
+		return adminHelp
+	case "stats":
+		return fmt.Sprintf("uptime: %d\ncounters: %d\ntimers: %d\ngauges: %d\nsets: %d\nEND\n\n",
+			int64(time.Since(s.startTime).Seconds()), len(s.counters), len(s.timers), len(s.gauges), len(s.sets))
+	case "counters":
+		return adminDump(s.counters)
+	case "timers":
+		return adminDump(s.timers)
+	case "gauges":
+		return adminDump(s.gauges)
+	case "sets":
+		members := make(map[string][]string)
+		for key, set := range s.sets {
+			members[key] = []string{}
+			for member := range set {
+				members[key] = append(members[key], member)
+			}
+		}
+		return adminDump(members)
+	case "delcounters":
+		return adminDelete(args, func(key string) bool {
+			_, ok := s.counters[key]
+			delete(s.counters, key)
+			return ok
+		})
+	case "deltimers":
+		return adminDelete(args, func(key string) bool {
+			_, ok := s.timers[key]
+			delete(s.timers, key)
+			delete(s.timerCounters, key)
+			delete(s.timerSeen, key)
+			delete(s.timerSeenSums, key)
+			return ok
+		})
+	case "delgauges":
+		return adminDelete(args, func(key string) bool {
+			_, ok := s.gauges[key]
+			delete(s.gauges, key)
+			delete(s.gaugeUpdated, key)
+			return ok
+		})
+	case "setgraphite":
+		// Switching Graphite servers closes the connections to the old
+		// ones, and takes effect from the next flush. The other backends
+		// keep their connections, and the new servers are kept across
+		// reloads until the config's own Graphite addresses change.
+		if len(args) == 0 {
+			return "ERROR: setgraphite host:port [host:port ...]\n"
+		}
+		for _, address := range args {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return fmt.Sprintf("ERROR: %s\n", err.Error())
+			}
+		}
+		if !s.graphiteOverridden {
+			s.graphiteOverridden = true
+			s.configGraphite = s.config.GraphiteAddresses
+		}
+		s.config.GraphiteAddresses = args
+		s.configureBackends()
+		return fmt.Sprintf("graphite: %s\nEND\n\n", strings.Join(args, ","))
+	case "delsets":
+		return adminDelete(args, func(key string) bool {
+			_, ok := s.sets[key]
+			delete(s.sets, key)
+			return ok
+		})
+	}
+	return "ERROR\n" + adminHelp
+}
+
+func adminDump(v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("ERROR: %s\n", err.Error())
+	}
+	return string(b) + "\nEND\n\n"
+}
+
+func adminDelete(keys []string, del func(key string) bool) string {
+	var reply string
+	for _, key := range keys {
+		if del(key) {
+			reply += fmt.Sprintf("deleted: %s\n", key)
+		} else {
+			reply += fmt.Sprintf("metric %s not found\n", key)
+		}
+	}
+	return reply + "END\n\n"
+}
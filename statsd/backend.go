@@ -0,0 +1,158 @@
+package statsd
+
+import (
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// Backend receives the aggregated metrics at every flush. Backends are
+// responsible for logging their own failures; a returned error marks the
+// flush as failed on the health check.
+type Backend interface {
+	Flush(metrics MetricSnapshot) error
+}
+
+// MetricSnapshot holds the metrics aggregated over one flush interval. Keys
+// are bucket names, followed by any tags as GraphiteTags segments
+// (";tag=value"). Backends must treat it as read only, since it is shared
+// between them.
+type MetricSnapshot struct {
+	Time time.Time
+	// Interval is the time actually elapsed since counters were
+	// previously flushed, which their rates are computed over.
+	Interval time.Duration
+
+	Counters map[string]float64 // running totals if CountersCumulative is set
+	Gauges   map[string]float64
+	Sets     map[string]int // number of distinct members
+	// CounterIncrements holds the change in each counter since the
+	// previous flush, which rates are computed from. It matches Counters
+	// unless CountersCumulative is set.
+	CounterIncrements map[string]float64
+	// Timers holds the sorted samples of each timer, which may be empty
+	// for a timer that received none this interval. TimerCounts holds the
+	// number of samples scaled by their sample rate.
+	Timers      map[string][]float64
+	TimerCounts map[string]float64
+	// TimerStats holds the statistics computed once from each timer's
+	// samples, including those for each percentile, in reporting order.
+	TimerStats map[string][]TimerStat
+
+	// CounterRates holds exponentially weighted moving averages of each
+	// counter's per-second rate over 1, 5 and 15 minutes.
+	CounterRates map[string][3]float64
+
+	// KeyValues holds the key/value events received since the previous
+	// flush, in the order they arrived, which are passed on unaggregated.
+	KeyValues []KeyValue
+
+	// SelfStats are metrics about the server itself.
+	SelfStats []SelfStat
+}
+
+// KeyValue is a single key/value ("|kv") event, sent on as a point of its
+// own, timestamped with when it was received.
+type KeyValue struct {
+	Key   string
+	Value float64
+	Time  time.Time
+}
+
+// SelfStat is an internal metric about the server itself.
+type SelfStat struct {
+	Name  string
+	Value int64
+}
+
+// TimerStat is a statistic computed from a timer's samples, such as "mean"
+// or "upper_90". Count is set for statistics which count samples.
+type TimerStat struct {
+	Name  string
+	Value float64
+	Count bool
+}
+
+// AddBackend registers a backend to be flushed to alongside those set up
+// from the config. It must be called before Start.
+func (s *Server) AddBackend(b Backend) {
+	s.extraBackends = append(s.extraBackends, b)
+}
+
+// graphiteBackend writes the Graphite plaintext protocol, or the pickle
+// protocol if pickle is set, to a Carbon server.
+type graphiteBackend struct {
+	s      *Server
+	conn   *connection
+	pickle bool
+}
+
+func (b *graphiteBackend) Flush(m MetricSnapshot) error {
+	var data []byte
+	if b.pickle {
+		// Carbon only accepts timestamps in seconds over pickle.
+		data = pickleMessages(b.s.graphiteText(m, time.Second))
+	} else {
+		data = b.s.graphiteText(m, b.s.config.timestampPrecision())
+	}
+	b.s.lastGraphiteData = data
+	return b.conn.Send(data)
+}
+
+// graphiteUDPMax is the largest datagram sent by graphiteUDPBackend, which
+// fits in a 1500 byte Ethernet MTU.
+const graphiteUDPMax = 1432
+
+// graphiteUDPBackend writes the Graphite plaintext protocol to a Carbon
+// server over UDP. Lines are packed into datagrams of up to graphiteUDPMax
+// bytes; a single longer line is sent on its own.
+type graphiteUDPBackend struct {
+	s       *Server
+	address string
+}
+
+func (b *graphiteUDPBackend) Flush(m MetricSnapshot) error {
+	data := b.s.graphiteText(m, b.s.config.timestampPrecision())
+	b.s.lastGraphiteData = data
+	if b.s.config.Debug {
+		slog.Debug("Send", "backend", "graphite udp "+b.address, "data", string(data))
+	}
+	conn, err := net.Dial(UDP, b.address)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer conn.Close()
+	for len(data) > 0 {
+		n := chunkLength(data, graphiteUDPMax)
+		if _, err := conn.Write(data[:n]); err != nil {
+			log.Println(err)
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// unixSocketBackend writes the Graphite plaintext protocol to a collector
+// listening on a Unix stream socket.
+type unixSocketBackend struct {
+	s    *Server
+	conn *connection
+}
+
+func (b *unixSocketBackend) Flush(m MetricSnapshot) error {
+	return b.conn.Send(b.s.graphiteText(m, b.s.config.timestampPrecision()))
+}
+
+// stdoutBackend writes the Graphite plaintext protocol to standard output.
+type stdoutBackend struct {
+	s *Server
+}
+
+func (b *stdoutBackend) Flush(m MetricSnapshot) error {
+	_, err := os.Stdout.Write(b.s.graphiteText(m, b.s.config.timestampPrecision()))
+	return err
+}
@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Check validates config and tries to connect to each Graphite server,
+// writing a summary to w, without binding any listeners. It returns an
+// error if the config is invalid or a Graphite server can't be reached.
+func Check(config Config, w io.Writer) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	listeners := []struct {
+		name    string
+		address string
+	}{
+		{"UDP", config.Address},
+		{"TCP", config.TCPAddress},
+		{"Unix socket", config.UnixSocket},
+		{"Prometheus", config.PrometheusAddress},
+		{"Admin", config.AdminAddress},
+		{"Health", config.HealthAddress},
+		{"HTTP ingest", config.HTTPIngestAddress},
+		{"Debug", config.DebugAddress},
+	}
+	for _, l := range listeners {
+		if l.address != "" {
+			fmt.Fprintf(w, "%s listener: %s\n", l.name, l.address)
+		}
+	}
+	percentiles := config.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = []int{config.PercentThreshold}
+	}
+	fmt.Fprintf(w, "Flush interval: %s\n", config.FlushInterval)
+	fmt.Fprintf(w, "Percentiles: %s\n", strings.Trim(strings.ReplaceAll(fmt.Sprint(percentiles), " ", ","), "[]"))
+	fmt.Fprintf(w, "Prefixes: stats %q, counters %q, gauges %q, timers %q\n",
+		config.StatsPrefix, config.CountersPrefix, config.GaugesPrefix, config.TimersPrefix)
+
+	tlsConfig, err := config.graphiteTLSConfig()
+	if err != nil {
+		return err
+	}
+	var addresses []string
+	if config.GraphiteUDP {
+		// There's no connection to test over UDP.
+		for _, address := range config.GraphiteAddresses {
+			fmt.Fprintf(w, "Graphite %s: UDP, not checked\n", address)
+		}
+	} else {
+		addresses = append(addresses, config.GraphiteAddresses...)
+	}
+	if config.PickleAddress != "" {
+		addresses = append(addresses, config.PickleAddress)
+	}
+	failed := 0
+	for _, address := range addresses {
+		c := newConnection("graphite "+address, address, false)
+		c.tlsConfig = tlsConfig
+		conn, err := c.dial()
+		if err != nil {
+			fmt.Fprintf(w, "Graphite %s: %s\n", address, err.Error())
+			failed++
+			continue
+		}
+		conn.Close()
+		fmt.Fprintf(w, "Graphite %s: ok\n", address)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d Graphite servers unreachable", failed, len(addresses))
+	}
+	return nil
+}
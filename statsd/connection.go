@@ -0,0 +1,170 @@
+package statsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	minBackoff  = time.Second
+	maxBackoff  = time.Minute
+	dialTimeout = 10 * time.Second
+
+	// writeTimeout bounds each flush's writes, so a backend which stops
+	// reading can't block the monitor goroutine, and with it aggregation.
+	writeTimeout = 10 * time.Second
+)
+
+var errBackingOff = errors.New("backing off after a failed connection")
+
+// connection is a TCP, or Unix stream, connection to a backend which is
+// held open across flushes and only re-established, subject to exponential
+// backoff, after a dial or write fails.
+type connection struct {
+	name    string
+	network string
+	address string
+	conn    net.Conn
+	backoff time.Duration
+	retryAt time.Time
+	debug   bool
+
+	// tlsConfig is set for connections which should use TLS.
+	tlsConfig *tls.Config
+
+	// writeTime is how long the last write took.
+	writeTime time.Duration
+
+	// pending holds the flushes waiting to be sent, oldest first, of
+	// which at most maxPending are kept besides the latest.
+	pending    [][]byte
+	maxPending int
+
+	// maxWrite, if non-zero, splits the data sent into writes of whole
+	// lines of at most this many bytes.
+	maxWrite int
+}
+
+// chunkLength returns the length of the first chunk of data to send when
+// writes are limited to max bytes: as many whole lines as fit, or a single
+// longer line on its own. A max of 0 means no limit.
+func chunkLength(data []byte, max int) int {
+	if max <= 0 || len(data) <= max {
+		return len(data)
+	}
+	if n := bytes.LastIndexByte(data[:max], '\n') + 1; n > 0 {
+		return n
+	}
+	if n := bytes.IndexByte(data, '\n') + 1; n > 0 {
+		return n
+	}
+	return len(data)
+}
+
+func newConnection(name, address string, debug bool) *connection {
+	return &connection{name: name, network: TCP, address: address, debug: debug}
+}
+
+// setTLSConfig sets the TLS settings used to dial. A TLS connection which is
+// already open is closed, keeping any queued flushes, so that the next one
+// picks up certificates which may have changed.
+func (c *connection) setTLSConfig(config *tls.Config) {
+	if c.tlsConfig != nil || config != nil {
+		c.Close()
+	}
+	c.tlsConfig = config
+}
+
+// failed closes the current connection, if any, and schedules the next
+// reconnection attempt.
+func (c *connection) failed() {
+	c.Close()
+	if c.backoff == 0 {
+		c.backoff = minBackoff
+	} else if c.backoff < maxBackoff {
+		c.backoff *= 2
+		if c.backoff > maxBackoff {
+			c.backoff = maxBackoff
+		}
+	}
+	c.retryAt = time.Now().Add(c.backoff)
+	log.Printf("%s unavailable, retrying in %s", c.name, c.backoff)
+}
+
+// Send writes data over the connection, dialing it first if needed. Data
+// that can't be sent is queued to be retried with the next flush, up to
+// maxPending flushes, after which the oldest is dropped and logged in debug
+// mode.
+func (c *connection) Send(data []byte) error {
+	c.writeTime = 0
+	c.pending = append(c.pending, data)
+	for len(c.pending) > c.maxPending+1 {
+		if c.debug {
+			slog.Debug("Dropped flush", "backend", c.name, "data", string(c.pending[0]))
+		}
+		c.pending = c.pending[1:]
+	}
+	for len(c.pending) > 0 {
+		if err := c.write(c.pending[0]); err != nil {
+			return err
+		}
+		c.pending = c.pending[1:]
+	}
+	return nil
+}
+
+// write writes data over the connection, dialing it first if needed.
+func (c *connection) write(data []byte) error {
+	if c.conn == nil {
+		if time.Now().Before(c.retryAt) {
+			return errBackingOff
+		}
+		conn, err := c.dial()
+		if err != nil {
+			log.Println(err)
+			c.failed()
+			return err
+		}
+		c.conn = conn
+	}
+	if c.debug {
+		slog.Debug("Send", "backend", c.name, "data", string(data))
+	}
+	start := time.Now()
+	err := c.conn.SetWriteDeadline(start.Add(writeTimeout))
+	for rest := data; len(rest) > 0 && err == nil; {
+		n := chunkLength(rest, c.maxWrite)
+		_, err = c.conn.Write(rest[:n])
+		rest = rest[n:]
+	}
+	c.writeTime += time.Since(start)
+	if err != nil {
+		log.Println(err)
+		c.failed()
+		return err
+	}
+	c.backoff = 0
+	return nil
+}
+
+// dial opens a new connection to the backend, using TLS if configured.
+func (c *connection) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if c.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, c.network, c.address, c.tlsConfig)
+	}
+	return dialer.Dial(c.network, c.address)
+}
+
+// Close closes the underlying connection if it is open.
+func (c *connection) Close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
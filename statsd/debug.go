@@ -0,0 +1,69 @@
+package statsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// debugState is the aggregation state served at /state on the debug
+// address, with set members listed in order.
+type debugState struct {
+	Counters map[string]float64   `json:"counters"`
+	Gauges   map[string]float64   `json:"gauges"`
+	Sets     map[string][]string  `json:"sets"`
+	Timers   map[string][]float64 `json:"timers"`
+}
+
+// lastFlushHandler serves the data last sent to Graphite, exactly as it was
+// written, or 404 if nothing has been.
+func (s *Server) lastFlushHandler(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	s.withState(func() {
+		data = s.lastGraphiteData
+	})
+	if data == nil {
+		http.Error(w, "nothing sent to Graphite yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// stateHandler serves the current aggregation maps as JSON.
+func (s *Server) stateHandler(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	var err error
+	s.withState(func() {
+		state := debugState{
+			Counters: s.counters,
+			Gauges:   s.gauges,
+			Sets:     make(map[string][]string, len(s.sets)),
+			Timers:   s.timers,
+		}
+		for key, members := range s.sets {
+			list := make([]string, 0, len(members))
+			for member := range members {
+				list = append(list, member)
+			}
+			sort.Strings(list)
+			state.Sets[key] = list
+		}
+		// The maps are marshalled here, since they mustn't be read once
+		// the monitor goroutine resumes.
+		body, err = json.MarshalIndent(state, "", "  ")
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (s *Server) listenDebug() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lastflush", s.lastFlushHandler)
+	mux.HandleFunc("/state", s.stateHandler)
+	return s.listenHTTP(s.config.DebugAddress, mux)
+}
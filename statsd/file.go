@@ -0,0 +1,64 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// rotated reports whether the open output file no longer matches the file at
+// the configured path, e.g. because logrotate moved it.
+func (s *Server) rotated() bool {
+	current, err := s.outputFile.Stat()
+	if err != nil {
+		return true
+	}
+	onDisk, err := os.Stat(s.config.OutputFile)
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(current, onDisk)
+}
+
+// fileBackend appends the Graphite plaintext protocol to the output file.
+type fileBackend struct {
+	s *Server
+}
+
+func (b *fileBackend) Flush(m MetricSnapshot) error {
+	return b.s.writeToFile(b.s.graphiteText(m, b.s.config.timestampPrecision()), m.Time)
+}
+
+// writeToFile appends a flush, preceded by a timestamp header, to the
+// output file.
+func (s *Server) writeToFile(data []byte, flushTime time.Time) error {
+	var err error
+	buffer := bytes.NewBufferString("")
+	fmt.Fprintf(buffer, "# flush %s\n", flushTime.Format(time.RFC3339))
+	buffer.Write(data)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.outputFile != nil && s.rotated() {
+			s.outputFile.Close()
+			s.outputFile = nil
+		}
+		if s.outputFile == nil {
+			f, err := os.OpenFile(s.config.OutputFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+			s.outputFile = f
+		}
+		_, err = s.outputFile.Write(buffer.Bytes())
+		if err == nil {
+			return nil
+		}
+		log.Println(err)
+		s.outputFile.Close()
+		s.outputFile = nil
+	}
+	return err
+}
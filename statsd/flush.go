@@ -0,0 +1,535 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// metricType selects the kinds of metric covered by a flush.
+type metricType int
+
+const (
+	counterMetrics metricType = 1 << iota
+	timerMetrics
+	gaugeMetrics
+	setMetrics
+	selfMetrics // statsd.* metrics about the server itself
+
+	allMetrics = counterMetrics | timerMetrics | gaugeMetrics | setMetrics | selfMetrics
+)
+
+// typeInterval returns the flush interval of a single metric type. Sets and
+// self metrics always use FlushInterval.
+func (c Config) typeInterval(t metricType) time.Duration {
+	var d time.Duration
+	switch t {
+	case counterMetrics:
+		d = c.CounterFlushInterval
+	case timerMetrics:
+		d = c.TimerFlushInterval
+	case gaugeMetrics:
+		d = c.GaugeFlushInterval
+	}
+	if d > 0 {
+		return d
+	}
+	return c.FlushInterval
+}
+
+// flushGroups returns the metric types to flush at each distinct flush
+// interval.
+func (c Config) flushGroups() map[time.Duration]metricType {
+	groups := make(map[time.Duration]metricType)
+	for t := counterMetrics; t <= selfMetrics; t <<= 1 {
+		groups[c.typeInterval(t)] |= t
+	}
+	return groups
+}
+
+// flushTicker sends types on due at every interval, starting offset after
+// the server starts, until it stops.
+func (s *Server) flushTicker(interval, offset time.Duration, types metricType, due chan<- metricType) {
+	if offset > 0 {
+		select {
+		case <-time.After(offset):
+		case <-s.stop:
+			return
+		}
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			select {
+			case due <- types:
+			case <-s.stop:
+				return
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// submit takes a snapshot of the given types of metric, resets them for the
+// next interval and hands the snapshot to every backend.
+func (s *Server) submit(types metricType) {
+	flushTime := time.Now()
+	// Rates are computed over the time since each type was itself last
+	// flushed, since a forced flush covers types with different intervals.
+	elapsed := make(map[metricType]time.Duration)
+	for t := counterMetrics; t <= selfMetrics; t <<= 1 {
+		if types&t == 0 {
+			continue
+		}
+		elapsed[t] = s.config.typeInterval(t)
+		if last, ok := s.lastFlush[t]; ok && flushTime.Sub(last) > 0 {
+			elapsed[t] = flushTime.Sub(last)
+		}
+		s.lastFlush[t] = flushTime
+	}
+	interval := elapsed[counterMetrics]
+	if interval <= 0 {
+		interval = s.config.typeInterval(counterMetrics)
+	}
+
+	// Ranging over a nil map skips the types which aren't due, or are
+	// disabled.
+	counters, gauges, sets, timers := s.counters, s.gauges, s.sets, s.timers
+	if types&counterMetrics == 0 || s.config.DisableCounters {
+		counters = nil
+	}
+	if types&gaugeMetrics == 0 || s.config.DisableGauges {
+		gauges = nil
+	}
+	if types&setMetrics == 0 || s.config.DisableSets {
+		sets = nil
+	}
+	if types&timerMetrics == 0 || s.config.DisableTimers {
+		timers = nil
+	}
+	m := MetricSnapshot{
+		Time:        flushTime,
+		Interval:    interval,
+		Counters:    make(map[string]float64, len(s.counters)),
+		Gauges:      make(map[string]float64, len(s.gauges)),
+		Sets:        make(map[string]int, len(s.sets)),
+		Timers:      make(map[string][]float64, len(s.timers)),
+		TimerCounts: make(map[string]float64, len(s.timers)),
+		TimerStats:  make(map[string][]TimerStat, len(s.timers)),
+
+		CounterIncrements: make(map[string]float64, len(s.counters)),
+		CounterRates:      make(map[string][3]float64, len(s.counters)),
+		KeyValues:         s.keyValues,
+	}
+	s.keyValues = nil
+	if counters != nil {
+		for key := range s.counterRates {
+			if _, ok := counters[key]; !ok {
+				s.decayRates(key, interval)
+			}
+		}
+	}
+	for key, c := range counters {
+		m.Counters[key] = c
+		m.CounterIncrements[key], m.CounterRates[key] = s.updateRates(key, c, interval)
+		if s.config.CountersCumulative {
+			continue
+		}
+		if s.config.DeleteIdleStats || s.config.DeleteCounters {
+			delete(s.counters, key)
+		} else {
+			s.counters[key] = 0
+		}
+	}
+	for key, g := range gauges {
+		if s.config.GaugeTTL > 0 && flushTime.Sub(s.gaugeUpdated[key]) > s.config.GaugeTTL {
+			delete(s.gauges, key)
+			delete(s.gaugeUpdated, key)
+			continue
+		}
+		m.Gauges[key] = g
+		if s.config.DeleteIdleStats || s.config.DeleteGauges {
+			delete(s.gauges, key)
+			delete(s.gaugeUpdated, key)
+		}
+	}
+	for key, members := range sets {
+		m.Sets[key] = len(members)
+		if s.config.DeleteIdleStats || s.config.DeleteSets {
+			delete(s.sets, key)
+		} else {
+			s.sets[key] = make(map[string]struct{})
+		}
+	}
+	for key, t := range timers {
+		sort.Float64s(t)
+		m.Timers[key] = t
+		m.TimerCounts[key] = s.timerCounters[key]
+		m.TimerStats[key] = s.timerStats(t, m.TimerCounts[key], elapsed[timerMetrics].Seconds())
+		if seen := s.timerSeen[key]; seen > len(t) {
+			seenSums(m.TimerStats[key], s.timerSeenSums[key], float64(seen)/float64(len(t)))
+		}
+		if s.config.TimerNamespace == "legacy" {
+			m.TimerStats[key] = legacyTimerStats(m.TimerStats[key])
+		}
+		if len(t) > 0 {
+			s.lastTimers[key] = t
+		}
+		delete(s.timerSeen, key)
+		delete(s.timerSeenSums, key)
+		if s.config.DeleteIdleStats || s.config.DeleteTimers {
+			delete(s.timers, key)
+			delete(s.timerCounters, key)
+		} else {
+			var z []float64
+			s.timers[key] = z
+			s.timerCounters[key] = 0
+		}
+	}
+
+	// Metrics about the daemon itself, reported under statsd.
+	if types&selfMetrics != 0 {
+		numStats := len(m.Counters) + len(m.Gauges) + len(m.Sets) + len(m.Timers)
+		m.SelfStats = []SelfStat{
+			{"numStats", int64(numStats)},
+			{"numCounters", int64(len(m.Counters))},
+			{"numGauges", int64(len(m.Gauges))},
+			{"numTimers", int64(len(m.Timers))},
+			{"numSets", int64(len(m.Sets))},
+			{"packetsReceived", atomic.SwapInt64(&s.receivedPackets, 0)},
+			{"packetsDropped", atomic.SwapInt64(&s.droppedPackets, 0)},
+			{"badLines", atomic.SwapInt64(&s.badLines, 0)},
+			{"queueDepth", int64(len(s.in))},
+			{"flushTime", s.flushDuration.Milliseconds()},
+			{"oldestSampleAge", s.oldestSampleAge(flushTime)},
+			// heartbeat is always 1, so there's a point every interval
+			// even with no traffic.
+			{"heartbeat", 1},
+		}
+		s.firstSample = time.Time{}
+		if len(s.graphite) > 0 {
+			queued := 0
+			for _, c := range s.graphite {
+				queued += len(c.pending)
+			}
+			m.SelfStats = append(m.SelfStats,
+				SelfStat{"graphiteWriteTime", s.graphiteWriteTime.Milliseconds()},
+				SelfStat{"graphiteErrors", s.graphiteErrors},
+				SelfStat{"graphiteQueueDepth", int64(queued)})
+			s.graphiteErrors = 0
+		}
+		if len(s.udpPorts) > 0 {
+			// The kernel's count is cumulative, so the change since the
+			// last report is sent. It goes back to zero once the
+			// listeners are closed on shutdown.
+			if drops, err := udpReceiveDrops(s.udpPorts); err == nil {
+				m.SelfStats = append(m.SelfStats, SelfStat{"udpReceiveBufferErrors", max(drops-s.udpDrops, 0)})
+				s.udpDrops = drops
+			}
+		}
+		if s.config.PerSourceRateLimit > 0 {
+			m.SelfStats = append(m.SelfStats, SelfStat{"rateLimited", atomic.SwapInt64(&s.rateLimited, 0)})
+		}
+		if len(s.config.Allowlist) > 0 {
+			m.SelfStats = append(m.SelfStats, SelfStat{"notAllowed", atomic.SwapInt64(&s.notAllowed, 0)})
+		}
+		if len(s.config.Blocklist) > 0 {
+			m.SelfStats = append(m.SelfStats, SelfStat{"blocked", atomic.SwapInt64(&s.blocked, 0)})
+		}
+		if s.config.MaxBuckets > 0 {
+			m.SelfStats = append(m.SelfStats, SelfStat{"cardinalityDropped", s.cardinalityDropped})
+			s.cardinalityDropped = 0
+		}
+	}
+
+	flushOK := true
+	graphiteOK := true
+	s.graphiteWriteTime = 0
+	for _, b := range s.backends {
+		err := b.Flush(m)
+		if g, ok := b.(*graphiteBackend); ok {
+			s.graphiteWriteTime += g.conn.writeTime
+			if err != nil {
+				graphiteOK = false
+				s.graphiteErrors++
+			}
+		}
+		if err != nil {
+			flushOK = false
+		}
+	}
+	s.recordFlush(flushOK, graphiteOK && len(s.graphite) > 0, flushTime)
+	s.flushDuration = time.Since(flushTime)
+}
+
+// oldestSampleAge returns the age in seconds of the first packet aggregated
+// since the last report of self metrics, or 0 if there hasn't been one.
+func (s *Server) oldestSampleAge(now time.Time) int64 {
+	if s.firstSample.IsZero() {
+		return 0
+	}
+	return int64(now.Sub(s.firstSample).Seconds())
+}
+
+// graphiteText renders a snapshot in the Graphite plaintext protocol, which
+// is also what the stdout, file and OpenTSDB backends are derived from.
+// Timestamps are given in units of precision.
+func (s *Server) graphiteText(m MetricSnapshot, precision time.Duration) []byte {
+	now := m.Time.UnixNano() / int64(precision)
+	elapsed := m.Interval.Seconds()
+	prefix := s.expandHost(s.config.GlobalPrefix)
+	suffix := s.expandHost(s.config.GlobalSuffix)
+	buffer := bytes.NewBufferString("")
+	for key, c := range m.Counters {
+		bucket, tags := s.graphiteKey(key)
+		// The rate uses the time actually elapsed, which is longer than
+		// the flush interval for a late flush and shorter for a forced one,
+		// and the increment, since c may be a running total.
+		rate := m.CounterIncrements[key] / elapsed
+		fmt.Fprintf(buffer, "%s%s%s%s%s %s %d\n", prefix, s.config.StatsPrefix, bucket, suffix, tags, s.config.formatValue(rate), now)
+		fmt.Fprintf(buffer, "%s%s%s%s%s %s %d\n", prefix, s.config.CountersPrefix, bucket, suffix, tags, s.config.formatValue(c), now)
+		fmt.Fprintf(buffer, "%s%s%s.count_ps%s%s %s %d\n", prefix, s.config.CountersPrefix, bucket, suffix, tags, s.config.formatValue(rate), now)
+		for i, rate := range m.CounterRates[key] {
+			fmt.Fprintf(buffer, "%s%s%s.%s%s%s %s %d\n", prefix, s.config.CountersPrefix, bucket, rateWindows[i].name, suffix, tags, s.config.formatValue(rate), now)
+		}
+	}
+	for key, g := range m.Gauges {
+		bucket, tags := s.graphiteKey(key)
+		fmt.Fprintf(buffer, "%s%s%s%s%s %s %d\n", prefix, s.config.GaugesPrefix, bucket, suffix, tags, s.config.formatValue(g), now)
+	}
+	for key, count := range m.Sets {
+		bucket, tags := s.graphiteKey(key)
+		fmt.Fprintf(buffer, "%s%ssets.%s.count%s%s %d %d\n", prefix, s.config.StatsPrefix, bucket, suffix, tags, count, now)
+	}
+	for key, stats := range m.TimerStats {
+		bucket, tags := s.graphiteKey(key)
+		for _, stat := range stats {
+			fmt.Fprintf(buffer, "%s%s%s.%s%s%s %s %d\n", prefix, s.config.TimersPrefix, bucket, stat.Name, suffix, tags, stat.format(s.config), now)
+		}
+	}
+	for _, kv := range m.KeyValues {
+		bucket, tags := s.graphiteKey(kv.Key)
+		ts := kv.Time.UnixNano() / int64(precision)
+		fmt.Fprintf(buffer, "%s%s%s%s %s %d\n", prefix, bucket, suffix, tags, s.config.formatValue(kv.Value), ts)
+	}
+	for _, stat := range m.SelfStats {
+		fmt.Fprintf(buffer, "%s%sstatsd.%s%s %d %d\n", prefix, s.config.StatsPrefix, stat.Name, suffix, stat.Value, now)
+	}
+	if d := s.config.BucketDelimiter; d != "" && d != "." {
+		return replaceDelimiter(buffer.Bytes(), d[0])
+	}
+	return buffer.Bytes()
+}
+
+// graphiteKey splits key into the bucket name and GraphiteTags suffix used
+// for its Graphite series, like splitKey, except that with TagsInPath the
+// tags are folded into the bucket name instead.
+func (s *Server) graphiteKey(key string) (bucket, tags string) {
+	bucket, tags = splitKey(key)
+	if s.config.TagsInPath {
+		return bucket + tagsPath(tags), ""
+	}
+	return bucket, tags
+}
+
+// replaceDelimiter replaces the dots separating the path segments of each
+// series name in a Graphite plaintext buffer with delimiter, leaving tags
+// and values alone.
+func replaceDelimiter(data []byte, delimiter byte) []byte {
+	for start := 0; start < len(data); {
+		end := bytes.IndexByte(data[start:], '\n')
+		if end < 0 {
+			end = len(data) - start
+		}
+		line := data[start : start+end]
+		name := line
+		if i := bytes.IndexAny(line, "; "); i >= 0 {
+			name = line[:i]
+		}
+		for i, c := range name {
+			if c == '.' {
+				name[i] = delimiter
+			}
+		}
+		start += end + 1
+	}
+	return data
+}
+
+// expandHost replaces the %HOST% token in a prefix or suffix with the local
+// hostname, with dots replaced so it forms a single Graphite path segment.
+func (s *Server) expandHost(template string) string {
+	host := strings.Replace(s.hostname, ".", "_", -1)
+	return strings.Replace(template, "%HOST%", host, -1)
+}
+
+// format renders the value of a timer statistic for the text backends.
+func (t TimerStat) format(c Config) string {
+	if t.Count {
+		return strconv.FormatInt(int64(math.Round(t.Value)), 10)
+	}
+	return c.formatValue(t.Value)
+}
+
+// timerStats computes the statistics reported for a timer from its sorted
+// samples t, sample rate weighted count and the seconds elapsed since the
+// previous flush. Timers with no samples in the
+// interval still report zeros so their series stay continuous.
+func (s *Server) timerStats(t []float64, weightedCount, elapsed float64) []TimerStat {
+	if len(t) == 0 {
+		stats := []TimerStat{
+			{"mean", 0, false}, {"upper", 0, false}, {"lower", 0, false}, {"count", 0, true}, {"count_ps", 0, false},
+			{"median", 0, false}, {"std", 0, false}, {"sum", 0, false}, {"sum_squares", 0, false},
+		}
+		for _, pct := range s.percentiles {
+			stats = append(stats,
+				TimerStat{fmt.Sprintf("mean_%d", pct), 0, false},
+				TimerStat{fmt.Sprintf("upper_%d", pct), 0, false},
+				TimerStat{fmt.Sprintf("lower_%d", pct), 0, false},
+				TimerStat{fmt.Sprintf("sum_%d", pct), 0, false})
+		}
+		if s.config.MaxTimerSamples > 0 {
+			stats = append(stats, TimerStat{"samples", 0, true})
+		}
+		return append(stats, s.histogramStats(t)...)
+	}
+
+	min := float64(t[0])
+	max := float64(t[len(t)-1])
+	count := len(t)
+	mid := count / 2
+	median := t[mid]
+	if count%2 == 0 {
+		median = (t[mid-1] + t[mid]) / 2
+	}
+
+	sum := float64(0)
+	sumSquares := float64(0)
+	for _, v := range t {
+		sum += v
+		sumSquares += v * v
+	}
+	// mean is over every sample; mean_N only covers each percentile.
+	mean := sum / float64(count)
+	sumOfDiffs := float64(0)
+	for _, v := range t {
+		sumOfDiffs += (v - mean) * (v - mean)
+	}
+	stddev := math.Sqrt(sumOfDiffs / float64(count))
+
+	stats := []TimerStat{
+		{"mean", mean, false},
+		{"upper", max, false},
+		{"lower", min, false},
+		{"count", weightedCount, true},
+		{"count_ps", weightedCount / elapsed, false},
+		{"median", median, false},
+		{"std", stddev, false},
+		{"sum", sum, false},
+		{"sum_squares", sumSquares, false},
+	}
+	for _, pct := range s.percentiles {
+		meanAtThreshold, minAtThreshold, maxAtThreshold, sumAtThreshold := thresholdStats(t, pct)
+		stats = append(stats,
+			TimerStat{fmt.Sprintf("mean_%d", pct), meanAtThreshold, false},
+			TimerStat{fmt.Sprintf("upper_%d", pct), maxAtThreshold, false},
+			TimerStat{fmt.Sprintf("lower_%d", pct), minAtThreshold, false},
+			TimerStat{fmt.Sprintf("sum_%d", pct), sumAtThreshold, false})
+	}
+	if s.config.MaxTimerSamples > 0 {
+		// count is still the number received; samples is how many were
+		// kept to compute the other statistics.
+		stats = append(stats, TimerStat{"samples", float64(count), true})
+	}
+	return append(stats, s.histogramStats(t)...)
+}
+
+// seenSums corrects the sums in stats, computed from the samples of a timer
+// kept under MaxTimerSamples, for the samples which were dropped. sum and
+// sum_squares are replaced by sums, those of every sample received, and
+// since only the kept samples can be ranked, each sum_N is scaled up by
+// scale, the ratio of samples received to those kept.
+func seenSums(stats []TimerStat, sums [2]float64, scale float64) {
+	for i, stat := range stats {
+		switch {
+		case stat.Name == "sum":
+			stats[i].Value = sums[0]
+		case stat.Name == "sum_squares":
+			stats[i].Value = sums[1]
+		case strings.HasPrefix(stat.Name, "sum_"):
+			stats[i].Value *= scale
+		}
+	}
+}
+
+// legacyTimerStats filters stats down to those sent by the original statsd:
+// mean, upper, lower and count, with mean_N and upper_N for each percentile.
+// The samples and histogram statistics are kept, since they're only sent
+// when configured.
+func legacyTimerStats(stats []TimerStat) []TimerStat {
+	var kept []TimerStat
+	for _, stat := range stats {
+		switch strings.TrimRightFunc(stat.Name, unicode.IsDigit) {
+		case "mean", "upper", "lower", "count", "samples", "mean_", "upper_":
+		default:
+			if !strings.HasPrefix(stat.Name, "histogram.") {
+				continue
+			}
+		}
+		kept = append(kept, stat)
+	}
+	return kept
+}
+
+// histogramStats counts the samples in the sorted slice t falling into each
+// of the TimerHistogram bins, each of which holds the samples greater than
+// the previous bin's upper bound and no greater than its own. Bounds have
+// dots replaced so they form a single Graphite path segment.
+func (s *Server) histogramStats(t []float64) []TimerStat {
+	if len(s.config.TimerHistogram) == 0 {
+		return nil
+	}
+	var stats []TimerStat
+	i := 0
+	for _, upper := range s.config.TimerHistogram {
+		n := 0
+		for ; i < len(t) && t[i] <= upper; i++ {
+			n++
+		}
+		bin := strings.Replace(strconv.FormatFloat(upper, 'f', -1, 64), ".", "_", -1)
+		stats = append(stats, TimerStat{"histogram.bin_" + bin, float64(n), true})
+	}
+	stats = append(stats, TimerStat{"histogram.bin_inf", float64(len(t) - i), true})
+	return stats
+}
+
+// thresholdStats returns the mean, lower and upper bounds and sum of the
+// values in the sorted slice t that fall within the given percentile.
+func thresholdStats(t []float64, pct int) (mean, lower, upper, sum float64) {
+	count := len(t)
+	numInThreshold := int(math.Ceil(float64(pct) / 100.0 * float64(count)))
+	if numInThreshold < 1 {
+		numInThreshold = 1
+	}
+	if numInThreshold > count {
+		numInThreshold = count
+	}
+	values := t[0:numInThreshold]
+
+	for i := 0; i < numInThreshold; i++ {
+		sum += values[i]
+	}
+	mean = sum / float64(numInThreshold)
+	lower = values[0]
+	upper = values[numInThreshold-1]
+	return mean, lower, upper, sum
+}
@@ -0,0 +1,191 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpperPercentileDiffersFromUpper(t *testing.T) {
+	config := DefaultConfig()
+	config.Percentiles = []int{90}
+	s, _ := newTestServer(t, config)
+	// 1 to 100, so the 90th percentile excludes the top ten samples.
+	samples := make([]float64, 100)
+	for i := range samples {
+		samples[i] = float64(i + 1)
+	}
+	stats := s.timerStats(samples, 100, 10)
+	if got := timerStat(t, stats, "upper"); got != 100 {
+		t.Errorf("upper = %v, want 100", got)
+	}
+	if got := timerStat(t, stats, "upper_90"); got != 90 {
+		t.Errorf("upper_90 = %v, want 90", got)
+	}
+	if got := timerStat(t, stats, "mean_90"); got != 45.5 {
+		t.Errorf("mean_90 = %v, want 45.5", got)
+	}
+}
+
+func TestCounterRateUsesElapsedInterval(t *testing.T) {
+	s, b := newTestServer(t, DefaultConfig())
+	process(s, "foo:40|c")
+	// The previous flush was 20s ago, twice the flush interval, as if
+	// this one were late.
+	s.lastFlush[counterMetrics] = time.Now().Add(-20 * time.Second)
+	m := flush(s, b)
+	if m.Interval < 20*time.Second || m.Interval > 21*time.Second {
+		t.Fatalf("interval = %s, want about 20s", m.Interval)
+	}
+	want := fmt.Sprintf("stats.counters.foo.count_ps %f ", 40/m.Interval.Seconds())
+	if text := string(s.graphiteText(m, time.Second)); !strings.Contains(text, want) {
+		t.Errorf("no %q in:\n%s", want, text)
+	}
+}
+
+// TestThresholdWindow checks which sorted samples fall within each
+// percentile, the ceiling of pct% of them and always at least one.
+func TestThresholdWindow(t *testing.T) {
+	tests := []struct {
+		samples                 int
+		pct                     int
+		mean, lower, upper, sum float64
+	}{
+		{10, 50, 3, 1, 5, 15},
+		{10, 100, 5.5, 1, 10, 55},
+		{10, 95, 5.5, 1, 10, 55},
+		{10, 1, 1, 1, 1, 1},
+		{3, 50, 1.5, 1, 2, 3},
+		{1, 90, 1, 1, 1, 1},
+		{2, 150, 1.5, 1, 2, 3},
+	}
+	for _, tt := range tests {
+		samples := make([]float64, tt.samples)
+		for i := range samples {
+			samples[i] = float64(i + 1)
+		}
+		mean, lower, upper, sum := thresholdStats(samples, tt.pct)
+		if mean != tt.mean || lower != tt.lower || upper != tt.upper || sum != tt.sum {
+			t.Errorf("%d samples at %d%%: mean %v, lower %v, upper %v, sum %v, want %v, %v, %v, %v",
+				tt.samples, tt.pct, mean, lower, upper, sum, tt.mean, tt.lower, tt.upper, tt.sum)
+		}
+	}
+}
+
+func TestLowerAndSumPercentile(t *testing.T) {
+	config := DefaultConfig()
+	config.Percentiles = []int{50}
+	s, b := newTestServer(t, config)
+	process(s, "req:4:2:3:1|ms")
+	stats := flush(s, b).TimerStats["req"]
+	if got := timerStat(t, stats, "lower_50"); got != 1 {
+		t.Errorf("lower_50 = %v, want 1", got)
+	}
+	if got := timerStat(t, stats, "sum_50"); got != 3 {
+		t.Errorf("sum_50 = %v, want 3", got)
+	}
+	if got := timerStat(t, stats, "upper_50"); got != 2 {
+		t.Errorf("upper_50 = %v, want 2", got)
+	}
+}
+
+func TestPercentThresholdValidated(t *testing.T) {
+	for _, pct := range []int{0, -10, 101, 150} {
+		config := DefaultConfig()
+		config.PercentThreshold = pct
+		if err := config.validate(); err == nil {
+			t.Errorf("percent threshold %d was accepted", pct)
+		}
+	}
+}
+
+func TestCumulativeCounterRate(t *testing.T) {
+	config := DefaultConfig()
+	config.CountersCumulative = true
+	s, b := newTestServer(t, config)
+	for i := 1; i <= 3; i++ {
+		process(s, "foo:10|c")
+		m := flush(s, b)
+		if got := m.Counters["foo"]; got != float64(10*i) {
+			t.Errorf("flush %d: total = %v, want %d", i, got, 10*i)
+		}
+		if got := m.CounterIncrements["foo"]; got != 10 {
+			t.Errorf("flush %d: increment = %v, want 10", i, got)
+		}
+		want := fmt.Sprintf("stats.counters.foo.count_ps %f ", 10/m.Interval.Seconds())
+		if text := string(s.graphiteText(m, time.Second)); !strings.Contains(text, want) {
+			t.Errorf("flush %d: no %q in:\n%s", i, want, text)
+		}
+	}
+}
+
+func TestCumulativeCounterRestored(t *testing.T) {
+	config := DefaultConfig()
+	config.CountersCumulative = true
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	s, b := newTestServer(t, config)
+	process(s, "foo:10|c")
+	flush(s, b)
+	if err := s.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, b = newTestServer(t, config)
+	if err := s.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	process(s, "foo:5|c")
+	m := flush(s, b)
+	if m.Counters["foo"] != 15 || m.CounterIncrements["foo"] != 5 {
+		t.Errorf("total = %v, increment = %v, want 15 and 5", m.Counters["foo"], m.CounterIncrements["foo"])
+	}
+}
+
+func TestDeletedCounterKeepsRates(t *testing.T) {
+	config := DefaultConfig()
+	config.DeleteCounters = true
+	s, b := newTestServer(t, config)
+	// Each flush comes a full interval after the previous one.
+	flushLater := func() MetricSnapshot {
+		s.lastFlush[counterMetrics] = time.Now().Add(-10 * time.Second)
+		return flush(s, b)
+	}
+	process(s, "foo:10|c")
+	if got := flushLater().CounterRates["foo"][0]; math.Abs(got-1) > 1e-3 {
+		t.Fatalf("rate_1m = %v, want 1", got)
+	}
+	// The rate doubles, which the moving average only partly follows.
+	process(s, "foo:20|c")
+	if got := flushLater().CounterRates["foo"][0]; got <= 1.1 || got >= 1.2 {
+		t.Errorf("rate_1m = %v, want about 1.15", got)
+	}
+
+	// An idle counter's rates decay, and are dropped after 15 minutes.
+	flushLater()
+	if r, ok := s.counterRates["foo"]; !ok || r.rates[0] >= 1 {
+		t.Errorf("idle rate state = %v (present %t), want a decayed rate", r.rates, ok)
+	}
+	for i := 0; i < 90; i++ {
+		flushLater()
+	}
+	if _, ok := s.counterRates["foo"]; ok {
+		t.Error("rate state kept for a counter idle for over 15 minutes")
+	}
+}
+
+func TestSampledTimerSums(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxTimerSamples = 2
+	s, b := newTestServer(t, config)
+	process(s, "t:10|ms", "t:10|ms", "t:10|ms", "t:10|ms")
+	stats := flush(s, b).TimerStats["t"]
+	want := map[string]float64{"count": 4, "samples": 2, "sum": 40, "sum_squares": 400, "sum_90": 40, "mean": 10}
+	for name, value := range want {
+		if got := timerStat(t, stats, name); got != value {
+			t.Errorf("%s = %v, want %v", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package statsd
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthState is updated by the UDP listeners and submit() and read by the
+// health check handler, so it has its own lock rather than going through
+// withState.
+type healthState struct {
+	sync.Mutex
+	listening         int // number of UDP listeners running
+	flushFailed       bool
+	lastGraphiteWrite time.Time
+}
+
+func (s *Server) setListening(listening bool) {
+	s.health.Lock()
+	defer s.health.Unlock()
+	if listening {
+		s.health.listening++
+	} else {
+		s.health.listening--
+	}
+}
+
+// recordFlush records the outcome of a flush. A flush with no Graphite
+// servers configured always counts as successful.
+func (s *Server) recordFlush(ok, toGraphite bool, flushTime time.Time) {
+	s.health.Lock()
+	defer s.health.Unlock()
+	s.health.flushFailed = !ok
+	if ok && toGraphite {
+		s.health.lastGraphiteWrite = flushTime
+	}
+}
+
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	s.health.Lock()
+	listening := s.health.listening > 0
+	flushOK := !s.health.flushFailed
+	lastWrite := s.health.lastGraphiteWrite
+	s.health.Unlock()
+
+	status := http.StatusOK
+	if !listening || !flushOK {
+		status = http.StatusServiceUnavailable
+	}
+	last := "never"
+	if !lastWrite.IsZero() {
+		last = lastWrite.Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "listening: %t\nlast flush ok: %t\nlast graphite write: %s\n", listening, flushOK, last)
+}
+
+func (s *Server) listenHealth() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.healthHandler)
+	return s.listenHTTP(s.config.HealthAddress, mux)
+}
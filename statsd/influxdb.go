@@ -0,0 +1,124 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	influxClient  = &http.Client{Timeout: 10 * time.Second}
+	influxEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+	// influxPrecision maps each TimestampPrecision to its name in the
+	// InfluxDB write API.
+	influxPrecision = map[time.Duration]string{
+		time.Second:      "s",
+		time.Millisecond: "ms",
+		time.Nanosecond:  "ns",
+	}
+)
+
+// influxLine writes a single InfluxDB line protocol point for bucket. The
+// tags are the GraphiteTags suffix returned by splitKey.
+func influxLine(buffer *bytes.Buffer, bucket, tags string, fields []string, ts int64) {
+	buffer.WriteString(influxEscaper.Replace(bucket))
+	if tags != "" {
+		for _, tag := range strings.Split(tags[1:], ";") {
+			kv := strings.SplitN(tag, "=", 2)
+			fmt.Fprintf(buffer, ",%s=%s", influxEscaper.Replace(kv[0]), influxEscaper.Replace(kv[1]))
+		}
+	}
+	fmt.Fprintf(buffer, " %s %d\n", strings.Join(fields, ","), ts)
+}
+
+// influxDBBackend writes the snapshot to InfluxDB using the line protocol.
+// Each bucket becomes a measurement, with a field per statistic.
+type influxDBBackend struct {
+	s *Server
+}
+
+func (b *influxDBBackend) Flush(m MetricSnapshot) error {
+	return b.s.sendToInfluxDB(b.s.influxText(m))
+}
+
+// influxText renders a snapshot in the InfluxDB line protocol.
+func (s *Server) influxText(m MetricSnapshot) []byte {
+	now := m.Time.UnixNano() / int64(s.config.timestampPrecision())
+	elapsed := m.Interval.Seconds()
+	buffer := bytes.NewBufferString("")
+	for key, c := range m.Counters {
+		bucket, tags := splitKey(key)
+		fields := []string{
+			"count=" + s.config.formatValue(c),
+			"count_ps=" + s.config.formatValue(m.CounterIncrements[key]/elapsed),
+		}
+		for i, rate := range m.CounterRates[key] {
+			fields = append(fields, rateWindows[i].name+"="+s.config.formatValue(rate))
+		}
+		influxLine(buffer, bucket, tags, fields, now)
+	}
+	for key, g := range m.Gauges {
+		bucket, tags := splitKey(key)
+		influxLine(buffer, bucket, tags, []string{"value=" + s.config.formatValue(g)}, now)
+	}
+	for key, count := range m.Sets {
+		bucket, tags := splitKey(key)
+		influxLine(buffer, bucket, tags, []string{fmt.Sprintf("count=%d", count)}, now)
+	}
+	for key, stats := range m.TimerStats {
+		bucket, tags := splitKey(key)
+		var fields []string
+		for _, stat := range stats {
+			fields = append(fields, stat.Name+"="+stat.format(s.config))
+		}
+		influxLine(buffer, bucket, tags, fields, now)
+	}
+	for _, kv := range m.KeyValues {
+		bucket, tags := splitKey(kv.Key)
+		ts := kv.Time.UnixNano() / int64(s.config.timestampPrecision())
+		influxLine(buffer, bucket, tags, []string{"value=" + s.config.formatValue(kv.Value)}, ts)
+	}
+	// Flushes of types with their own interval carry no self metrics, and
+	// a point without fields is invalid.
+	if len(m.SelfStats) > 0 {
+		var selfFields []string
+		for _, stat := range m.SelfStats {
+			selfFields = append(selfFields, fmt.Sprintf("%s=%d", stat.Name, stat.Value))
+		}
+		influxLine(buffer, "statsd", "", selfFields, now)
+	}
+	return buffer.Bytes()
+}
+
+// sendToInfluxDB POSTs a line protocol payload to the InfluxDB write URL.
+func (s *Server) sendToInfluxDB(data []byte) error {
+	if s.config.Debug {
+		slog.Debug("Send", "backend", "influxdb", "data", string(data))
+	}
+	// The precision parameter tells InfluxDB the unit of the timestamps.
+	writeURL, err := url.Parse(s.config.InfluxDBAddress)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	query := writeURL.Query()
+	query.Set("precision", influxPrecision[s.config.timestampPrecision()])
+	writeURL.RawQuery = query.Encode()
+	resp, err := influxClient.Post(writeURL.String(), "text/plain; charset=utf-8", bytes.NewReader(data))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("InfluxDB write failed: %s", resp.Status)
+		return fmt.Errorf("InfluxDB write failed: %s", resp.Status)
+	}
+	return nil
+}
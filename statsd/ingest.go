@@ -0,0 +1,43 @@
+package statsd
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+)
+
+// maxIngestBody limits the size of a POST to the HTTP ingest endpoint.
+const maxIngestBody = 1 << 20
+
+// ingestHandler accepts newline delimited metrics in a POST body, as they
+// would be sent over UDP, for clients which can only make HTTP requests.
+func (s *Server) ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST metrics, one per line", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := s.sourcePrefix(r.RemoteAddr)
+	rejected := 0
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxIngestBody))
+	for scanner.Scan() {
+		if !s.handleLine(scanner.Text(), prefix, false) {
+			rejected++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rejected > 0 {
+		http.Error(w, fmt.Sprintf("%d lines rejected", rejected), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listenHTTPIngest() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.ingestHandler)
+	return s.listenHTTP(s.config.HTTPIngestAddress, mux)
+}
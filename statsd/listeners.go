@@ -0,0 +1,229 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// addListener registers a listener to be closed on shutdown.
+func (s *Server) addListener(l io.Closer) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// closeListeners closes all registered listeners so no new data arrives.
+func (s *Server) closeListeners() {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+// stopListeners closes the listeners and waits for the datagrams already
+// read to be parsed.
+func (s *Server) stopListeners() {
+	s.closeListeners()
+	s.readers.Wait()
+	close(s.datagrams)
+	s.workers.Wait()
+}
+
+// datagram is a packet read by a datagram listener, waiting to be parsed.
+// message comes from s.packets and is returned there once parsed.
+type datagram struct {
+	remaddr net.Addr
+	message *[]byte
+	n       int
+}
+
+// worker parses datagrams until the listeners are stopped. Each worker
+// reuses a single buffer.
+func (s *Server) worker() {
+	defer s.workers.Done()
+	var buf bytes.Buffer
+	for d := range s.datagrams {
+		buf.Reset()
+		buf.Write((*d.message)[:d.n])
+		s.packets.Put(d.message)
+		s.handleMessage(d.remaddr, &buf)
+	}
+}
+
+// readDatagrams reads packets from listener into buffers from s.packets and
+// queues them for the workers until listener is closed.
+func (s *Server) readDatagrams(listener net.PacketConn) {
+	for {
+		message := s.packets.Get().(*[]byte)
+		n, remaddr, err := listener.ReadFrom(*message)
+		if errors.Is(err, net.ErrClosed) {
+			s.packets.Put(message)
+			return
+		}
+		if err != nil {
+			s.packets.Put(message)
+			continue
+		}
+		if n == len(*message) {
+			log.Printf("Packet of %d bytes may have been truncated, consider raising -max-udp-packet-size", n)
+		}
+		if s.config.Debug {
+			slog.Debug("Packet received", "data", string((*message)[0:n]))
+		}
+		s.datagrams <- datagram{remaddr, message, n}
+	}
+}
+
+// listenUDP binds each of the comma separated UDP addresses. An address
+// which can't be bound is logged and skipped, unless none of them can be.
+func (s *Server) listenUDP() error {
+	var errs []error
+	bound := 0
+	for _, address := range strings.Split(s.config.Address, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if err := s.listenUDPAddress(address); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		bound++
+	}
+	if bound == 0 {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Println(err)
+	}
+	return nil
+}
+
+func (s *Server) listenUDPAddress(addr string) error {
+	network := s.config.UDPNetwork
+	if network == "" {
+		network = UDP
+	}
+	address, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return fmt.Errorf("can't resolve UDP address %q: %w", addr, err)
+	}
+	listener, err := net.ListenUDP(network, address)
+	if err != nil {
+		return fmt.Errorf("can't listen on UDP address %q: %w", addr, err)
+	}
+	s.setRecvBuffer(listener)
+	s.udpPorts = append(s.udpPorts, listener.LocalAddr().(*net.UDPAddr).Port)
+	s.addListener(listener)
+	s.readers.Add(1)
+	go s.udpListener(listener)
+	return nil
+}
+
+// setRecvBuffer applies RecvBufferSize to a datagram listener. The kernel
+// may cap the size, for instance at net.core.rmem_max on Linux.
+func (s *Server) setRecvBuffer(listener interface{ SetReadBuffer(int) error }) {
+	if s.config.RecvBufferSize <= 0 {
+		return
+	}
+	if err := listener.SetReadBuffer(s.config.RecvBufferSize); err != nil {
+		log.Printf("Can't set receive buffer size: %s", err.Error())
+	}
+}
+
+func (s *Server) udpListener(listener *net.UDPConn) {
+	defer s.readers.Done()
+	defer listener.Close()
+	s.setListening(true)
+	defer s.setListening(false)
+	s.readDatagrams(listener)
+}
+
+func (s *Server) listenUnix() error {
+	// A socket file left behind by an unclean exit would make the bind fail.
+	if err := os.Remove(s.config.UnixSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	address := &net.UnixAddr{Name: s.config.UnixSocket, Net: "unixgram"}
+	listener, err := net.ListenUnixgram("unixgram", address)
+	if err != nil {
+		return err
+	}
+	s.setRecvBuffer(listener)
+	s.addListener(listener)
+	s.readers.Add(1)
+	go s.unixListener(listener)
+	return nil
+}
+
+func (s *Server) unixListener(listener *net.UnixConn) {
+	defer s.readers.Done()
+	defer listener.Close()
+	s.readDatagrams(listener)
+}
+
+func (s *Server) listenTCP() error {
+	listener, err := net.Listen(TCP, s.config.TCPAddress)
+	if err != nil {
+		return err
+	}
+	s.addListener(listener)
+	go s.acceptLoop(listener, s.handleConnection)
+	return nil
+}
+
+// acceptLoop hands each connection accepted on listener to handle until the
+// listener is closed.
+func (s *Server) acceptLoop(listener net.Listener, handle func(net.Conn)) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		go handle(conn)
+	}
+}
+
+// handleConnection reads newline delimited metrics from a stream connection
+// until the client disconnects.
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	prefix := s.sourcePrefix(conn.RemoteAddr().String())
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if s.config.Debug {
+			slog.Debug("Line received", "line", scanner.Text())
+		}
+		s.handleLine(scanner.Text(), prefix, false)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println(err)
+	}
+}
+
+// listenHTTP serves handler on address until the server is stopped.
+func (s *Server) listenHTTP(address string, handler http.Handler) error {
+	listener, err := net.Listen(TCP, address)
+	if err != nil {
+		return err
+	}
+	s.addListener(listener)
+	go http.Serve(listener, handler)
+	return nil
+}
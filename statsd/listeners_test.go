@@ -0,0 +1,49 @@
+package statsd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// packetConn is a net.PacketConn which reads the same datagram forever.
+type packetConn struct {
+	net.PacketConn
+	datagram []byte
+}
+
+func (c packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return copy(p, c.datagram), nil, nil
+}
+
+// BenchmarkReadBuffers compares taking read buffers from s.packets, as
+// readDatagrams and worker do, against allocating one per datagram.
+func BenchmarkReadBuffers(b *testing.B) {
+	config := DefaultConfig()
+	config.Address = ""
+	s, err := New(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := packetConn{datagram: []byte("api.requests:1|c\napi.time:320|ms|@0.5")}
+	var buf bytes.Buffer
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			message := s.packets.Get().(*[]byte)
+			n, _, _ := conn.ReadFrom(*message)
+			buf.Reset()
+			buf.Write((*message)[:n])
+			s.packets.Put(message)
+		}
+	})
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			message := make([]byte, config.MaxPacketSize)
+			n, _, _ := conn.ReadFrom(message)
+			buf.Reset()
+			buf.Write(message[:n])
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// openTSDBBackend sends the snapshot to OpenTSDB using the telnet protocol.
+type openTSDBBackend struct {
+	s    *Server
+	conn *connection
+}
+
+func (b *openTSDBBackend) Flush(m MetricSnapshot) error {
+	precision := b.s.config.timestampPrecision()
+	if precision < time.Millisecond {
+		precision = time.Millisecond
+	}
+	return b.conn.Send(b.s.openTSDBLines(b.s.graphiteText(m, precision)))
+}
+
+// openTSDBLines translates a Graphite plaintext buffer into OpenTSDB telnet
+// "put" lines, so both backends report identically named series. Graphite
+// tags become OpenTSDB tags; untagged series get a host tag since OpenTSDB
+// requires at least one.
+func (s *Server) openTSDBLines(data []byte) []byte {
+	buffer := bytes.NewBufferString("")
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		name, tags := splitKey(fields[0])
+		if tags == "" {
+			tags = " host=" + s.hostname
+		} else {
+			tags = strings.Replace(tags, ";", " ", -1)
+		}
+		fmt.Fprintf(buffer, "put %s %s %s%s\n", name, fields[2], fields[1], tags)
+	}
+	return buffer.Bytes()
+}
@@ -0,0 +1,294 @@
+package statsd
+
+import (
+	"bytes"
+	"log/slog"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// parseTags parses a DogStatsD style tag list such as "env:prod,region:us".
+// Tags without a value are ignored since Graphite requires tag=value pairs.
+// It reports false if the list has characters which aren't allowed in tags,
+// rather than guess which series the metric was meant for.
+func parseTags(s string) (map[string]string, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, true
+	}
+	if !tagsRegexp.MatchString(s) {
+		return nil, false
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			continue
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, true
+}
+
+// bucketKey returns the key a bucket is aggregated under. Tags are sorted
+// and appended as GraphiteTags segments (";tag=value") so that series with
+// different tags don't collide and tag order on the wire doesn't matter.
+func bucketKey(bucket string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return bucket
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := bucket
+	for _, name := range names {
+		key += ";" + name + "=" + tags[name]
+	}
+	return key
+}
+
+// splitKey splits a key produced by bucketKey into the bucket name and its
+// GraphiteTags suffix, which is empty for untagged buckets.
+func splitKey(key string) (bucket, tags string) {
+	if i := strings.Index(key, ";"); i >= 0 {
+		return key[:i], key[i:]
+	}
+	return key, ""
+}
+
+// tagsPath converts the GraphiteTags suffix returned by splitKey into path
+// segments, as in ".env.prod.region.us". Dots in values are replaced so
+// each forms a single segment.
+func tagsPath(tags string) string {
+	if tags == "" {
+		return ""
+	}
+	var path strings.Builder
+	for _, tag := range strings.Split(tags[1:], ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		path.WriteString("." + kv[0] + "." + strings.Replace(kv[1], ".", "_", -1))
+	}
+	return path.String()
+}
+
+// These are compiled once rather than for every incoming packet.
+var (
+	// sanitizeRegexp matches characters which aren't allowed in bucket names.
+	// It is applied to the parsed bucket only, so values, modifiers and tags
+	// are left untouched.
+	sanitizeRegexp = regexp.MustCompile("[^a-zA-Z0-9\\-_\\.]")
+	packetRegexp   = regexp.MustCompile("([^:\\|]+):([^\\|]+)\\|(c|ms|g|s|kv)(\\|@([0-9\\.]+))?(\\|#([^\\|]*))?")
+	tagsRegexp     = regexp.MustCompile("^[a-zA-Z0-9_\\-\\.:,]+$")
+	numberRegexp   = regexp.MustCompile("^[\\-\\+]?[0-9\\.]+$")
+)
+
+// isFinite reports whether value is a plain decimal number which parses
+// without overflowing.
+func isFinite(value string) bool {
+	if !numberRegexp.MatchString(value) {
+		return false
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	return err == nil && !math.IsInf(f, 0) && !math.IsNaN(f)
+}
+
+// remoteHost returns the IP address of remote, a "host:port" address, or
+// "" if it has none.
+func remoteHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// sourcePrefix returns the prefix added to the buckets of metrics sent from
+// remote, a "host:port" address, if SourcePrefix is set. The IP address has
+// its dots (or colons) replaced so it forms a single Graphite path segment.
+func (s *Server) sourcePrefix(remote string) string {
+	if !s.config.SourcePrefix {
+		return ""
+	}
+	host := remoteHost(remote)
+	if host == "" {
+		return ""
+	}
+	return strings.NewReplacer(".", "_", ":", "_").Replace(host) + "."
+}
+
+// matchesAny reports whether bucket matches any of patterns.
+func matchesAny(patterns []*regexp.Regexp, bucket string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMessage parses a datagram sent from remaddr, which may be nil or
+// have no IP address when it came over a Unix socket.
+func (s *Server) handleMessage(remaddr net.Addr, buf *bytes.Buffer) {
+	var prefix string
+	if remaddr != nil {
+		if s.limiter != nil {
+			if host := remoteHost(remaddr.String()); host != "" && !s.limiter.allow(host, time.Now()) {
+				atomic.AddInt64(&s.rateLimited, 1)
+				return
+			}
+		}
+		prefix = s.sourcePrefix(remaddr.String())
+	}
+	// Clients batch several metrics per datagram separated by newlines,
+	// each of which is parsed independently.
+	for _, line := range strings.Split(buf.String(), "\n") {
+		s.handleLine(line, prefix, false)
+	}
+}
+
+// Parse parses a datagram of newline separated metrics into packets, as
+// the server does with the default config. Metrics which can't be parsed
+// are skipped.
+func Parse(datagram []byte) []Packet {
+	var packets []Packet
+	for _, line := range strings.Split(string(datagram), "\n") {
+		p, _, _ := parseLine(line, ".")
+		packets = append(packets, p...)
+	}
+	return packets
+}
+
+// parseLine parses a single metric line into packets, translating
+// delimiter in bucket names to dots. It also returns the number of metrics
+// with a sample rate outside (0, 1], which are kept with a rate of 1 since
+// the rate would skew the value, or divide by zero, and the number of
+// values skipped because they weren't valid for their type or had invalid
+// tags.
+func parseLine(line, delimiter string) (packets []Packet, badRates, badValues int) {
+	for _, item := range packetRegexp.FindAllStringSubmatch(line, -1) {
+		bucket := item[1]
+		if delimiter != "" && delimiter != "." {
+			bucket = strings.ReplaceAll(bucket, delimiter, ".")
+		}
+		bucket = sanitizeRegexp.ReplaceAllString(bucket, "")
+		if bucket == "" {
+			continue
+		}
+		sampleRate := 1.0
+		if item[5] != "" {
+			rate, err := strconv.ParseFloat(item[5], 32)
+			if err != nil || rate <= 0 || rate > 1 {
+				badRates++
+			} else {
+				sampleRate = rate
+			}
+		}
+		tags, ok := parseTags(item[7])
+		if !ok {
+			badValues++
+			continue
+		}
+
+		// Timers may carry several samples separated by colons, as in
+		// "foo:1:2:3|ms", each of which is recorded.
+		values := []string{item[2]}
+		if item[3] == "ms" {
+			values = strings.Split(item[2], ":")
+		}
+		for _, value := range values {
+			value = strings.TrimSpace(value)
+			// Sets accept arbitrary values and gauges may be explicitly
+			// deleted; everything else must be a finite number, since a
+			// single Inf or NaN would poison every statistic of its bucket.
+			if item[3] != "s" && !(item[3] == "g" && value == "delete") && !isFinite(value) {
+				badValues++
+				continue
+			}
+			packets = append(packets, Packet{
+				Bucket:   bucket,
+				Value:    value,
+				Modifier: item[3],
+				Sampling: float32(sampleRate),
+				Tags:     tags,
+			})
+		}
+	}
+	return packets, badRates, badValues
+}
+
+// handleLine parses a single metric line and queues the resulting packets,
+// with prefix added to their buckets. If the queue is full, packets are
+// dropped unless wait is set, in which case it waits for room. It reports
+// false for a non-empty line which yielded no metrics.
+func (s *Server) handleLine(line, prefix string, wait bool) bool {
+	packets, badRates, badValues := parseLine(line, s.config.BucketDelimiter)
+	if badRates > 0 {
+		atomic.AddInt64(&s.badLines, int64(badRates))
+		if s.config.Debug {
+			slog.Debug("Bad sample rate", "line", line)
+		}
+	}
+	if len(packets) == 0 {
+		if strings.TrimSpace(line) == "" {
+			return true
+		}
+		atomic.AddInt64(&s.badLines, 1)
+		if s.config.Debug {
+			slog.Debug("Bad line", "line", line)
+		}
+		return false
+	}
+	// A line yielding no metrics is a single bad line, but otherwise each
+	// value skipped, such as a NaN among a timer's samples, counts.
+	if badValues > 0 {
+		atomic.AddInt64(&s.badLines, int64(badValues))
+		if s.config.Debug {
+			slog.Debug("Bad value", "line", line)
+		}
+	}
+	if len(s.repeaters) > 0 {
+		s.repeat(strings.TrimSpace(line))
+	}
+	for _, packet := range packets {
+		if s.config.disabled(packet.Modifier) {
+			continue
+		}
+		if s.config.LowercaseBuckets {
+			packet.Bucket = strings.ToLower(packet.Bucket)
+		}
+		if len(s.config.Allowlist) > 0 && !matchesAny(s.config.Allowlist, packet.Bucket) {
+			atomic.AddInt64(&s.notAllowed, 1)
+			continue
+		}
+		if matchesAny(s.config.Blocklist, packet.Bucket) {
+			atomic.AddInt64(&s.blocked, 1)
+			continue
+		}
+		packet.Bucket = prefix + packet.Bucket
+
+		if s.config.Debug {
+			slog.Debug("Packet", "bucket", packet.Bucket, "value", packet.Value,
+				"modifier", packet.Modifier, "sampling", packet.Sampling, "tags", packet.Tags)
+		}
+
+		atomic.AddInt64(&s.receivedPackets, 1)
+		if wait {
+			s.in <- packet
+			continue
+		}
+		select {
+		case s.in <- packet:
+		default:
+			atomic.AddInt64(&s.droppedPackets, 1)
+		}
+	}
+	return true
+}
@@ -0,0 +1,253 @@
+package statsd
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram string
+		want     []Packet
+	}{
+		{
+			name:     "counter",
+			datagram: "foo:1|c",
+			want:     []Packet{{Bucket: "foo", Value: "1", Modifier: "c", Sampling: 1}},
+		},
+		{
+			name:     "negative counter",
+			datagram: "foo:-3|c",
+			want:     []Packet{{Bucket: "foo", Value: "-3", Modifier: "c", Sampling: 1}},
+		},
+		{
+			name:     "timer",
+			datagram: "req.time:320|ms",
+			want:     []Packet{{Bucket: "req.time", Value: "320", Modifier: "ms", Sampling: 1}},
+		},
+		{
+			name:     "gauge",
+			datagram: "queue:72|g",
+			want:     []Packet{{Bucket: "queue", Value: "72", Modifier: "g", Sampling: 1}},
+		},
+		{
+			name:     "gauge delta",
+			datagram: "queue:+5|g",
+			want:     []Packet{{Bucket: "queue", Value: "+5", Modifier: "g", Sampling: 1}},
+		},
+		{
+			name:     "gauge delete",
+			datagram: "queue:delete|g",
+			want:     []Packet{{Bucket: "queue", Value: "delete", Modifier: "g", Sampling: 1}},
+		},
+		{
+			name:     "set",
+			datagram: "users:alice|s",
+			want:     []Packet{{Bucket: "users", Value: "alice", Modifier: "s", Sampling: 1}},
+		},
+		{
+			name:     "sample rate",
+			datagram: "foo:1|c|@0.1",
+			want:     []Packet{{Bucket: "foo", Value: "1", Modifier: "c", Sampling: 0.1}},
+		},
+		{
+			name:     "sample rate out of range",
+			datagram: "foo:1|c|@2",
+			want:     []Packet{{Bucket: "foo", Value: "1", Modifier: "c", Sampling: 1}},
+		},
+		{
+			name:     "tags",
+			datagram: "foo:1|c|#env:prod,region:us",
+			want: []Packet{{Bucket: "foo", Value: "1", Modifier: "c", Sampling: 1,
+				Tags: map[string]string{"env": "prod", "region": "us"}}},
+		},
+		{
+			name:     "sample rate and tags",
+			datagram: "foo:1|ms|@0.5|#env:prod",
+			want: []Packet{{Bucket: "foo", Value: "1", Modifier: "ms", Sampling: 0.5,
+				Tags: map[string]string{"env": "prod"}}},
+		},
+		{
+			name:     "multiple lines",
+			datagram: "a:1|c\nb:2|ms\n\nc:3|g\n",
+			want: []Packet{
+				{Bucket: "a", Value: "1", Modifier: "c", Sampling: 1},
+				{Bucket: "b", Value: "2", Modifier: "ms", Sampling: 1},
+				{Bucket: "c", Value: "3", Modifier: "g", Sampling: 1},
+			},
+		},
+		{
+			name:     "sanitized bucket",
+			datagram: "foo bar/baz:1|c",
+			want:     []Packet{{Bucket: "foobarbaz", Value: "1", Modifier: "c", Sampling: 1}},
+		},
+		{name: "empty", datagram: ""},
+		{name: "no value", datagram: "foo|c"},
+		{name: "no type", datagram: "foo:1"},
+		{name: "unknown type", datagram: "foo:1|x"},
+		{name: "non-numeric counter", datagram: "foo:abc|c"},
+		{name: "empty bucket", datagram: "!!:1|c"},
+		{name: "invalid tag value", datagram: "foo:1|c|#env:pr/od,region:us"},
+		{name: "tag value starting with an invalid character", datagram: "foo:1|c|#path:/api"},
+		{
+			name:     "malformed line among good ones",
+			datagram: "garbage\nfoo:1|c",
+			want:     []Packet{{Bucket: "foo", Value: "1", Modifier: "c", Sampling: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse([]byte(tt.datagram))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.datagram, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFinite(t *testing.T) {
+	tests := map[string]bool{
+		"1":     true,
+		"-2.5":  true,
+		"+3":    true,
+		"0.001": true,
+		"Inf":   false,
+		"+Inf":  false,
+		"-Inf":  false,
+		"NaN":   false,
+		"1e400": false,
+		"1e3":   false,
+		"0x10":  false,
+		"":      false,
+	}
+	for value, want := range tests {
+		if got := isFinite(value); got != want {
+			t.Errorf("isFinite(%q) = %t, want %t", value, got, want)
+		}
+	}
+}
+
+func TestNonFiniteValuesAreBadLines(t *testing.T) {
+	tests := []struct {
+		line    string
+		packets int
+		bad     int64
+	}{
+		{"foo:NaN|c", 0, 1},
+		{"foo:Inf|g", 0, 1},
+		{"foo:1e400|ms", 0, 1},
+		// The valid samples of a timer are kept and each bad one counted.
+		{"foo:1:NaN|ms", 1, 1},
+		{"foo:1:Inf:2:NaN|ms", 2, 2},
+	}
+	for _, tt := range tests {
+		s, _ := newTestServer(t, DefaultConfig())
+		s.handleLine(tt.line, "", false)
+		if got := len(s.in); got != tt.packets {
+			t.Errorf("%q queued %d packets, want %d", tt.line, got, tt.packets)
+		}
+		if got := s.badLines; got != tt.bad {
+			t.Errorf("%q counted %d bad lines, want %d", tt.line, got, tt.bad)
+		}
+	}
+}
+
+func TestZeroSampleRate(t *testing.T) {
+	s, b := newTestServer(t, DefaultConfig())
+	// A rate of 0 would divide by zero, so the value is counted as is.
+	process(s, "foo:1|c|@0")
+	if s.badLines != 1 {
+		t.Errorf("counted %d bad lines, want 1", s.badLines)
+	}
+	if got := flush(s, b).Counters["foo"]; got != 1 {
+		t.Errorf("foo = %v, want 1", got)
+	}
+}
+
+func TestHandleMessageMultiLine(t *testing.T) {
+	s, b := newTestServer(t, DefaultConfig())
+	s.handleMessage(nil, bytes.NewBufferString("a:1|c\nb:2|g\n\nc:3|ms\na:2|c\n"))
+	if s.receivedPackets != 4 {
+		t.Errorf("received %d packets, want 4", s.receivedPackets)
+	}
+	for len(s.in) > 0 {
+		s.processPacket(<-s.in)
+	}
+	m := flush(s, b)
+	if m.Counters["a"] != 3 || m.Gauges["b"] != 2 || m.TimerCounts["c"] != 1 {
+		t.Errorf("got counters %v, gauges %v, timer counts %v", m.Counters, m.Gauges, m.TimerCounts)
+	}
+}
+
+func TestTimerWithSeveralValues(t *testing.T) {
+	if got := len(Parse([]byte("foo:1:2:3|ms"))); got != 3 {
+		t.Errorf("parsed %d packets, want 3", got)
+	}
+	s, b := newTestServer(t, DefaultConfig())
+	process(s, "foo:1:2:3|ms")
+	stats := flush(s, b).TimerStats["foo"]
+	if got := timerStat(t, stats, "count"); got != 3 {
+		t.Errorf("count = %v, want 3", got)
+	}
+	if got := timerStat(t, stats, "sum"); got != 6 {
+		t.Errorf("sum = %v, want 6", got)
+	}
+}
+
+func TestTagOrderDoesNotMatter(t *testing.T) {
+	config := DefaultConfig()
+	config.TagsInPath = true
+	s, b := newTestServer(t, config)
+	process(s, "a:1|c|#env:prod,region:us", "a:2|c|#region:us,env:prod")
+	m := flush(s, b)
+	if len(m.Counters) != 1 || m.Counters["a;env=prod;region=us"] != 3 {
+		t.Fatalf("counters = %v, want a;env=prod;region=us of 3", m.Counters)
+	}
+	if bucket, tags := s.graphiteKey("a;env=prod;region=us"); bucket != "a.env.prod.region.us" || tags != "" {
+		t.Errorf("graphiteKey = %q, %q, want a.env.prod.region.us", bucket, tags)
+	}
+}
+
+// BenchmarkHandleMessage compares parsing with the regexps compiled once
+// against compiling them for every datagram, as handleMessage used to.
+func BenchmarkHandleMessage(b *testing.B) {
+	datagram := "api.requests:1|c\napi.time:320|ms|@0.5\nqueue.depth:+3|g\nusers:alice|s"
+	run := func(b *testing.B, compile bool) {
+		config := DefaultConfig()
+		config.Address = ""
+		s, err := New(config)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if compile {
+				sanitizeRegexp = regexp.MustCompile(sanitizeRegexp.String())
+				packetRegexp = regexp.MustCompile(packetRegexp.String())
+				numberRegexp = regexp.MustCompile(numberRegexp.String())
+			}
+			s.handleMessage(nil, bytes.NewBufferString(datagram))
+			for len(s.in) > 0 {
+				<-s.in
+			}
+		}
+	}
+	b.Run("precompiled", func(b *testing.B) { run(b, false) })
+	b.Run("per-datagram", func(b *testing.B) { run(b, true) })
+}
+
+func TestInvalidTagsAreBadLines(t *testing.T) {
+	for _, line := range []string{"foo:1|c|#env:pr/od,region:us", "foo:1|c|#path:/api"} {
+		s, b := newTestServer(t, DefaultConfig())
+		process(s, line)
+		if s.badLines != 1 {
+			t.Errorf("%q counted %d bad lines, want 1", line, s.badLines)
+		}
+		if m := flush(s, b); len(m.Counters) != 0 {
+			t.Errorf("%q flushed %v, want nothing", line, m.Counters)
+		}
+	}
+}
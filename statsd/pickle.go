@@ -0,0 +1,80 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// picklePerMessage limits the number of datapoints in each pickle message,
+// keeping them well under the 1MB Carbon accepts.
+const picklePerMessage = 500
+
+// Pickle protocol 2 opcodes, see Python's pickletools.
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// pickleMessages translates a Graphite plaintext buffer into Carbon pickle
+// protocol messages: each is a big-endian length header followed by a
+// pickled list of (path, (timestamp, value)) tuples.
+func pickleMessages(data []byte) []byte {
+	out := bytes.NewBufferString("")
+	var batch [][]string
+	flushBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		p := pickleList(batch)
+		binary.Write(out, binary.BigEndian, uint32(len(p)))
+		out.Write(p)
+		batch = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		batch = append(batch, fields)
+		if len(batch) == picklePerMessage {
+			flushBatch()
+		}
+	}
+	flushBatch()
+	return out.Bytes()
+}
+
+// pickleList pickles a list of datapoints, each given as the name, value
+// and timestamp fields of a plaintext line.
+func pickleList(datapoints [][]string) []byte {
+	buffer := bytes.NewBuffer([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	for _, fields := range datapoints {
+		value, _ := strconv.ParseFloat(fields[1], 64)
+		ts, _ := strconv.ParseInt(fields[2], 10, 32)
+
+		buffer.WriteByte(pickleBinUnicode)
+		binary.Write(buffer, binary.LittleEndian, uint32(len(fields[0])))
+		buffer.WriteString(fields[0])
+		buffer.WriteByte(pickleBinInt)
+		binary.Write(buffer, binary.LittleEndian, int32(ts))
+		buffer.WriteByte(pickleBinFloat)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(value))
+		buffer.WriteByte(pickleTuple2)
+		buffer.WriteByte(pickleTuple2)
+	}
+	buffer.WriteByte(pickleAppends)
+	buffer.WriteByte(pickleStop)
+	return buffer.Bytes()
+}
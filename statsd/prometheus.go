@@ -0,0 +1,122 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	prometheusNameRegexp  = regexp.MustCompile("[^a-zA-Z0-9_:]")
+	prometheusLabelRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
+)
+
+type prometheusFamily struct {
+	kind  string
+	lines []string
+}
+
+// prometheusName converts a bucket into a valid Prometheus metric name.
+func prometheusName(bucket string) string {
+	name := prometheusNameRegexp.ReplaceAllString(bucket, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// prometheusLabels converts the GraphiteTags suffix returned by splitKey
+// into a Prometheus label set, with any extra name/value pairs appended.
+func prometheusLabels(tags string, extra ...string) string {
+	pairs := append([]string{}, extra...)
+	if tags != "" {
+		for _, tag := range strings.Split(tags[1:], ";") {
+			pairs = append(pairs, strings.SplitN(tag, "=", 2)...)
+		}
+	}
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		name := prometheusLabelRegexp.ReplaceAllString(pairs[i], "_")
+		value := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", name, value))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	sort.Strings(labels)
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// prometheusMetrics renders the current state in the Prometheus text
+// exposition format. It must only be called from the monitor() goroutine,
+// see withState.
+func (s *Server) prometheusMetrics() []byte {
+	families := make(map[string]*prometheusFamily)
+	add := func(name, kind, line string) {
+		f, ok := families[name]
+		if !ok {
+			f = &prometheusFamily{kind: kind}
+			families[name] = f
+		}
+		f.lines = append(f.lines, line)
+	}
+
+	for key, total := range s.counterTotals {
+		bucket, tags := splitKey(key)
+		name := prometheusName(bucket) + "_total"
+		add(name, "counter", fmt.Sprintf("%s%s %f", name, prometheusLabels(tags), total))
+	}
+	for key, g := range s.gauges {
+		bucket, tags := splitKey(key)
+		name := prometheusName(bucket)
+		add(name, "gauge", fmt.Sprintf("%s%s %f", name, prometheusLabels(tags), g))
+	}
+	for key, count := range s.timerCounts {
+		bucket, tags := splitKey(key)
+		name := prometheusName(bucket)
+		if t := s.lastTimers[key]; len(t) > 0 {
+			for _, pct := range s.percentiles {
+				_, _, upper, _ := thresholdStats(t, pct)
+				quantile := fmt.Sprintf("%g", float64(pct)/100)
+				add(name, "summary", fmt.Sprintf("%s%s %f", name,
+					prometheusLabels(tags, "quantile", quantile), upper))
+			}
+		}
+		add(name, "summary", fmt.Sprintf("%s_sum%s %f", name, prometheusLabels(tags), s.timerSums[key]))
+		add(name, "summary", fmt.Sprintf("%s_count%s %f", name, prometheusLabels(tags), count))
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer := bytes.NewBufferString("")
+	for _, name := range names {
+		f := families[name]
+		sort.Strings(f.lines)
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", name, f.kind)
+		for _, line := range f.lines {
+			fmt.Fprintln(buffer, line)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func (s *Server) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	s.withState(func() {
+		body = s.prometheusMetrics()
+	})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(body)
+}
+
+func (s *Server) listenPrometheus() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.prometheusHandler)
+	return s.listenHTTP(s.config.PrometheusAddress, mux)
+}
@@ -0,0 +1,71 @@
+package statsd
+
+import (
+	"sync"
+	"time"
+)
+
+// idleSourceTimeout is the least time a source must be silent before its
+// token bucket is forgotten. It is longer for rates so low that the bucket
+// takes longer to refill, so forgetting it never changes whether its
+// packets are allowed.
+const idleSourceTimeout = time.Minute
+
+// sourceLimiter limits the packets accepted from each source IP address
+// with a token bucket per source, which holds up to a second's worth of
+// packets, or a single packet for rates below one per second. It is shared
+// by the worker goroutines, so has its own lock.
+type sourceLimiter struct {
+	sync.Mutex
+	rate        float64 // packets per second
+	capacity    float64 // tokens a bucket holds
+	idleTimeout time.Duration
+	sources     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newSourceLimiter(rate float64) *sourceLimiter {
+	capacity := max(rate, 1)
+	return &sourceLimiter{
+		rate:        rate,
+		capacity:    capacity,
+		idleTimeout: max(idleSourceTimeout, time.Duration(capacity/rate*float64(time.Second))),
+		sources:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// allow reports whether a packet from source is within its budget, taking
+// a token from its bucket if so.
+func (l *sourceLimiter) allow(source string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.lastCleanup) > l.idleTimeout {
+		for s, b := range l.sources {
+			if now.Sub(b.last) > l.idleTimeout {
+				delete(l.sources, s)
+			}
+		}
+		l.lastCleanup = now
+	}
+	b, ok := l.sources[source]
+	if !ok {
+		b = &tokenBucket{tokens: l.capacity, last: now}
+		l.sources[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.capacity {
+		b.tokens = l.capacity
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
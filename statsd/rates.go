@@ -0,0 +1,72 @@
+package statsd
+
+import (
+	"math"
+	"time"
+)
+
+// rateWindows are the periods over which moving average counter rates are
+// reported, like the 1, 5 and 15 minute load averages.
+var rateWindows = [3]struct {
+	name   string
+	window time.Duration
+}{
+	{"rate_1m", time.Minute},
+	{"rate_5m", 5 * time.Minute},
+	{"rate_15m", 15 * time.Minute},
+}
+
+// counterRate is the moving average state of a counter.
+type counterRate struct {
+	rates [3]float64
+	// total is the counter's value at the last flush, from which the
+	// increment is worked out when CountersCumulative is set.
+	total float64
+	// idle is how long the counter has gone unsent since it was deleted,
+	// with DeleteCounters or DeleteIdleStats.
+	idle time.Duration
+}
+
+// updateRates folds the value c of a counter, flushed after elapsed, into
+// its exponentially weighted moving average rates. It returns the increment
+// since the previous flush, which is c unless CountersCumulative is set,
+// and the rates. The decay depends on elapsed so the windows stay accurate
+// whatever the flush interval. A new counter starts at its current rate.
+func (s *Server) updateRates(key string, c float64, elapsed time.Duration) (float64, [3]float64) {
+	increment := c
+	r, ok := s.counterRates[key]
+	if s.config.CountersCumulative {
+		increment = c - r.total
+		r.total = c
+	}
+	r.idle = 0
+	rate := increment / elapsed.Seconds()
+	for i, w := range rateWindows {
+		if !ok {
+			r.rates[i] = rate
+			continue
+		}
+		alpha := 1 - math.Exp(-elapsed.Seconds()/w.window.Seconds())
+		r.rates[i] += alpha * (rate - r.rates[i])
+	}
+	s.counterRates[key] = r
+	return increment, r.rates
+}
+
+// decayRates folds an interval of elapsed without increments into the
+// rates of a counter which was deleted after a flush and hasn't been sent
+// since, so they carry on smoothly if it comes back. They are dropped once
+// it has been idle for longer than the longest window.
+func (s *Server) decayRates(key string, elapsed time.Duration) {
+	r := s.counterRates[key]
+	r.idle += elapsed
+	if r.idle > rateWindows[len(rateWindows)-1].window {
+		delete(s.counterRates, key)
+		return
+	}
+	for i, w := range rateWindows {
+		alpha := 1 - math.Exp(-elapsed.Seconds()/w.window.Seconds())
+		r.rates[i] -= alpha * r.rates[i]
+	}
+	s.counterRates[key] = r
+}
@@ -0,0 +1,30 @@
+package statsd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// dialRepeaters connects to each of the repeat addresses. Repeaters are UDP
+// sockets to other statsd instances which receive a copy of every metric
+// line before it is aggregated locally.
+func (s *Server) dialRepeaters(addresses []string) error {
+	for _, address := range addresses {
+		conn, err := net.Dial(UDP, address)
+		if err != nil {
+			return fmt.Errorf("Repeater %s: %s", address, err.Error())
+		}
+		s.repeaters = append(s.repeaters, conn)
+	}
+	return nil
+}
+
+// repeat forwards a metric line to every repeater.
+func (s *Server) repeat(line string) {
+	for _, conn := range s.repeaters {
+		if _, err := conn.Write([]byte(line)); err != nil && s.config.Debug {
+			slog.Debug("Repeat failed", "address", conn.RemoteAddr().String(), "error", err.Error())
+		}
+	}
+}
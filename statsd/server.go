@@ -0,0 +1,949 @@
+// Package statsd implements a statsd server: it receives metrics over UDP,
+// TCP and Unix datagram sockets, aggregates them in memory and flushes them
+// to Graphite and other backends at a fixed interval.
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TCP = "tcp"
+	UDP = "udp"
+)
+
+type Packet struct {
+	Bucket   string
+	Value    string
+	Modifier string
+	Sampling float32
+	Tags     map[string]string
+}
+
+// Config holds the settings of a Server. Backends and listeners whose
+// address is empty are disabled.
+type Config struct {
+	Address       string // comma separated UDP service addresses
+	UDPNetwork    string // udp, or udp4 or udp6 to bind one address family
+	TCPAddress    string
+	UnixSocket    string // Unix datagram socket path
+	MaxPacketSize int    // maximum UDP and Unix datagram size
+	Workers       int    // datagram parsing goroutines, defaults to the number of CPUs
+	SourcePrefix  bool   // prepend the sender's IP address to bucket names
+
+	// RecvBufferSize, if non-zero, sets the size in bytes of the kernel
+	// receive buffer of the UDP and Unix datagram listeners. Datagrams
+	// arriving while it is full are dropped by the kernel.
+	RecvBufferSize int
+
+	// PerSourceRateLimit is the number of datagrams per second accepted
+	// from each source IP address, 0 for no limit.
+	PerSourceRateLimit float64
+
+	// LowercaseBuckets lowercases incoming bucket names, so names which
+	// differ only in case are aggregated together.
+	LowercaseBuckets bool
+
+	GraphiteAddresses []string
+	PickleAddress     string // Carbon pickle receiver address
+	GraphiteUDP       bool   // send to GraphiteAddresses over UDP rather than TCP
+	GraphiteQueueSize int    // failed flushes kept to retry per Graphite server
+	GraphiteTLS       bool   // connect to Graphite over TLS
+	GraphiteTLSCA     string // CA certificate file to verify Graphite with
+	GraphiteTLSCert   string // client certificate file
+	GraphiteTLSKey    string // client key file
+	Stdout            bool   // write each flush to standard output
+	OutputFile        string // append each flush to this file
+	OpenTSDBAddress   string
+	InfluxDBAddress   string // InfluxDB write URL
+	BackendUnixSocket string // Unix stream socket to write the Graphite plaintext protocol to
+	RepeatAddresses   []string
+	MaxFlushBytes     int    // largest write of plaintext lines to Graphite or OpenTSDB, 0 for no limit
+	StateFile         string // aggregation state is saved here by Stop and restored by Start
+
+	FlushInterval    time.Duration
+	FlushJitter      bool // offset flushes by a random fraction of the interval
+	PercentThreshold int
+	Percentiles      []int // defaults to PercentThreshold
+	TimerHistogram   []float64
+	TimerUnitScale   float64 // incoming timer values are multiplied by this, if non-zero
+	MaxTimerSamples  int     // samples kept per timer each interval, 0 for all
+	TimerNamespace   string  // "legacy" sends only the original statsd timer statistics, "new" if empty
+	BucketDelimiter  string  // path delimiter of incoming and Graphite series names, "." if empty
+	StatsPrefix      string
+	CountersPrefix   string
+	GaugesPrefix     string
+	TimersPrefix     string
+	MaxBuckets       int  // limit on distinct buckets across all types, 0 for none
+	Debug            bool // log packets and flushes with slog at debug level
+
+	// CounterFlushInterval, TimerFlushInterval and GaugeFlushInterval
+	// override FlushInterval for one type of metric when non-zero.
+	CounterFlushInterval time.Duration
+	TimerFlushInterval   time.Duration
+	GaugeFlushInterval   time.Duration
+
+	// GlobalPrefix is prepended and GlobalSuffix appended to every series
+	// name, after any timer statistic, with %HOST% expanded to the
+	// hostname.
+	GlobalPrefix string
+	GlobalSuffix string
+
+	// TagsInPath folds tags into Graphite series names as name.value
+	// segments, in order of name, rather than sending them as
+	// GraphiteTags.
+	TagsInPath bool
+
+	// Renames are applied in order to each incoming bucket name before it
+	// is aggregated.
+	Renames []Rename
+
+	// DisableCounters, DisableTimers, DisableGauges and DisableSets drop
+	// metrics of that type as they are parsed.
+	DisableCounters bool
+	DisableTimers   bool
+	DisableGauges   bool
+	DisableSets     bool
+
+	// If Allowlist is set, metrics whose bucket names match none of it
+	// are dropped as they are parsed, as are those matching any of
+	// Blocklist.
+	Allowlist []*regexp.Regexp
+	Blocklist []*regexp.Regexp
+
+	// SampleGaugeDeltas scales gauge deltas (+N or -N) by their sample
+	// rate, as for counters. Other gauge values are set as sent.
+	SampleGaugeDeltas bool
+
+	// GaugeNoNegative clamps gauges at zero when a delta would take them
+	// below it, for values such as queue depths which can't be negative.
+	GaugeNoNegative bool
+
+	// CountersCumulative keeps the running total of each counter across
+	// flushes instead of resetting it, for backends which expect monotonic
+	// counters.
+	CountersCumulative bool
+
+	// ValueFormat is the fmt verb, such as "%g" or "%.2f", used to render
+	// values for the text backends, "%f" if empty. Timer counts and set
+	// sizes are always sent as integers.
+	ValueFormat string
+
+	// TimestampPrecision is the unit of the timestamps sent to backends:
+	// time.Second (the default if zero), time.Millisecond or
+	// time.Nanosecond. Pickle always uses seconds and OpenTSDB at most
+	// milliseconds, as they accept nothing finer.
+	TimestampPrecision time.Duration
+
+	// DeleteIdleStats is shorthand for all of the type specific settings
+	// below, which stop values being sent for inactive metrics.
+	DeleteIdleStats bool
+	DeleteCounters  bool
+	DeleteTimers    bool
+	DeleteGauges    bool
+	DeleteSets      bool
+	GaugeTTL        time.Duration // 0 keeps gauges forever
+
+	HealthAddress     string
+	HTTPIngestAddress string // accepts metrics POSTed to /metrics
+	AdminAddress      string
+	PrometheusAddress string
+	DebugAddress      string // serves /lastflush and /state
+}
+
+// Rename rewrites bucket names matching Pattern to Replacement, which may
+// refer to capture groups as in regexp.Regexp.ReplaceAllString.
+type Rename struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// DefaultConfig returns the settings used by the statsd-go command when no
+// flags are given.
+func DefaultConfig() Config {
+	return Config{
+		Address:          ":8125",
+		UDPNetwork:       UDP,
+		MaxPacketSize:    1432,
+		FlushInterval:    10 * time.Second,
+		PercentThreshold: 90,
+		TimerUnitScale:   1,
+		TimerNamespace:   "new",
+		StatsPrefix:      "stats.",
+		CountersPrefix:   "stats.counters.",
+		GaugesPrefix:     "stats.gauges.",
+		TimersPrefix:     "stats.timers.",
+		BucketDelimiter:  ".",
+	}
+}
+
+func (c Config) validate() error {
+	if c.FlushInterval <= 0 {
+		return errors.New("flush interval must be positive")
+	}
+	switch c.UDPNetwork {
+	case "", UDP, "udp4", "udp6":
+	default:
+		return fmt.Errorf("invalid UDP network %q, must be udp, udp4 or udp6", c.UDPNetwork)
+	}
+	if c.TimerUnitScale < 0 {
+		return errors.New("timer unit scale can't be negative")
+	}
+	switch c.TimerNamespace {
+	case "", "new", "legacy":
+	default:
+		return fmt.Errorf("invalid timer namespace %q, must be legacy or new", c.TimerNamespace)
+	}
+	if c.CounterFlushInterval < 0 || c.TimerFlushInterval < 0 || c.GaugeFlushInterval < 0 {
+		return errors.New("flush intervals can't be negative")
+	}
+	if c.PercentThreshold <= 0 || c.PercentThreshold > 100 {
+		return fmt.Errorf("percent threshold %d out of range (1-100)", c.PercentThreshold)
+	}
+	for _, pct := range c.Percentiles {
+		if pct <= 0 || pct > 100 {
+			return fmt.Errorf("percentile %d out of range (1-100)", pct)
+		}
+	}
+	switch c.TimestampPrecision {
+	case 0, time.Second, time.Millisecond, time.Nanosecond:
+	default:
+		return fmt.Errorf("invalid timestamp precision %s, must be 1s, 1ms or 1ns", c.TimestampPrecision)
+	}
+	if c.ValueFormat != "" {
+		// The format must render a plain number for Carbon to parse.
+		if _, err := strconv.ParseFloat(c.formatValue(1.5), 64); err != nil {
+			return fmt.Errorf("invalid value format %q", c.ValueFormat)
+		}
+	}
+	if len(c.BucketDelimiter) > 1 || strings.ContainsAny(c.BucketDelimiter, ":|@#;, \t\r\n") {
+		return fmt.Errorf("invalid bucket delimiter %q", c.BucketDelimiter)
+	}
+	prefixes := []string{c.StatsPrefix, c.CountersPrefix, c.GaugesPrefix, c.TimersPrefix, c.GlobalPrefix, c.GlobalSuffix}
+	for _, prefix := range prefixes {
+		if strings.ContainsAny(prefix, " \t\r\n") {
+			return fmt.Errorf("prefix %q contains whitespace", prefix)
+		}
+	}
+	for i, upper := range c.TimerHistogram {
+		if i > 0 && upper <= c.TimerHistogram[i-1] {
+			return errors.New("histogram bins must be in increasing order")
+		}
+	}
+	if c.GraphiteUDP && c.GraphiteTLS && len(c.GraphiteAddresses) > 0 {
+		return errors.New("Graphite TLS can't be used over UDP")
+	}
+	_, err := c.graphiteTLSConfig()
+	return err
+}
+
+// timestampPrecision returns the unit of output timestamps.
+func (c Config) timestampPrecision() time.Duration {
+	if c.TimestampPrecision <= 0 {
+		return time.Second
+	}
+	return c.TimestampPrecision
+}
+
+// disabled reports whether metrics with the given modifier are dropped. It
+// is called for every packet on the listener goroutines, so it takes a
+// pointer and reads only the Disable settings, which Reload never changes.
+func (c *Config) disabled(modifier string) bool {
+	switch modifier {
+	case "c":
+		return c.DisableCounters
+	case "ms":
+		return c.DisableTimers
+	case "g":
+		return c.DisableGauges
+	case "s":
+		return c.DisableSets
+	}
+	return false
+}
+
+// formatValue renders a value sent to the text backends using ValueFormat.
+func (c Config) formatValue(v float64) string {
+	if c.ValueFormat == "" {
+		return fmt.Sprintf("%f", v)
+	}
+	return fmt.Sprintf(c.ValueFormat, v)
+}
+
+// graphiteTLSConfig returns the TLS settings for Graphite connections, or
+// nil if they shouldn't use TLS.
+func (c Config) graphiteTLSConfig() (*tls.Config, error) {
+	if !c.GraphiteTLS {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if c.GraphiteTLSCA != "" {
+		pem, err := os.ReadFile(c.GraphiteTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.GraphiteTLSCA)
+		}
+	}
+	if c.GraphiteTLSCert != "" || c.GraphiteTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.GraphiteTLSCert, c.GraphiteTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// reloadable lists the settings which are only used on the monitor()
+// goroutine, and so can be changed by Reload without a restart.
+var reloadable = map[string]bool{
+	"GraphiteAddresses":  true,
+	"PickleAddress":      true,
+	"GraphiteUDP":        true,
+	"GraphiteQueueSize":  true,
+	"MaxFlushBytes":      true,
+	"GraphiteTLS":        true,
+	"GraphiteTLSCA":      true,
+	"GraphiteTLSCert":    true,
+	"GraphiteTLSKey":     true,
+	"Stdout":             true,
+	"OutputFile":         true,
+	"OpenTSDBAddress":    true,
+	"InfluxDBAddress":    true,
+	"BackendUnixSocket":  true,
+	"PercentThreshold":   true,
+	"Percentiles":        true,
+	"TimerHistogram":     true,
+	"TimerUnitScale":     true,
+	"MaxTimerSamples":    true,
+	"TimerNamespace":     true,
+	"GlobalPrefix":       true,
+	"GlobalSuffix":       true,
+	"TagsInPath":         true,
+	"Renames":            true,
+	"CountersCumulative": true,
+	"TimestampPrecision": true,
+	"ValueFormat":        true,
+	"SampleGaugeDeltas":  true,
+	"GaugeNoNegative":    true,
+	"StatsPrefix":        true,
+	"CountersPrefix":     true,
+	"GaugesPrefix":       true,
+	"TimersPrefix":       true,
+	"DeleteIdleStats":    true,
+	"DeleteCounters":     true,
+	"DeleteTimers":       true,
+	"DeleteGauges":       true,
+	"DeleteSets":         true,
+	"GaugeTTL":           true,
+	"MaxBuckets":         true,
+}
+
+// Server aggregates metrics and flushes them to the configured backends.
+type Server struct {
+	// receivedPackets counts parsed packets, droppedPackets those
+	// discarded because in was full, badLines non-empty lines which
+	// yielded no metrics or had an invalid sample rate, rateLimited
+	// datagrams over PerSourceRateLimit, notAllowed metrics missing from
+	// the Allowlist and blocked those matching the Blocklist. They are
+	// updated from the listener goroutines so must be accessed
+	// atomically, and are kept first for 64-bit alignment.
+	receivedPackets int64
+	droppedPackets  int64
+	badLines        int64
+	rateLimited     int64
+	notAllowed      int64
+	blocked         int64
+
+	// limiter enforces PerSourceRateLimit, if set.
+	limiter *sourceLimiter
+
+	config   Config
+	hostname string
+
+	// The aggregation maps below (and the derived state used for
+	// Prometheus) are owned by the monitor() goroutine and are never
+	// locked. Code running on any other goroutine must not touch them
+	// directly; instead it should use withState, which runs a function on
+	// the monitor() goroutine between packets and flushes.
+	in       chan Packet
+	counters map[string]float64
+	timers   map[string][]float64
+	gauges   map[string]float64
+	sets     map[string]map[string]struct{}
+
+	// keyValues holds the key/value events to be passed on at the next
+	// flush.
+	keyValues []KeyValue
+
+	// gaugeUpdated holds the time each gauge was last set, for GaugeTTL.
+	gaugeUpdated map[string]time.Time
+
+	// timerCounters holds the number of timer samples per bucket scaled by
+	// their sample rate, which is what .count reports.
+	timerCounters map[string]float64
+
+	// timerSeen holds the number of samples each timer has received this
+	// interval, kept or not, for reservoir sampling under MaxTimerSamples.
+	timerSeen map[string]int
+	// timerSeenSums holds the sum of the values of those samples, and of
+	// their squares, which the kept samples alone would under-report.
+	timerSeenSums map[string][2]float64
+
+	// Prometheus counters and summary counts must be monotonic, so running
+	// totals are kept alongside the per-interval maps.
+	counterTotals map[string]float64
+	timerCounts   map[string]float64
+	timerSums     map[string]float64
+
+	// counterRates holds the moving average rates of each counter.
+	counterRates map[string]counterRate
+
+	// lastTimers holds the sorted samples from the last flush, so scrapes
+	// always see quantiles over a complete interval.
+	lastTimers map[string][]float64
+
+	// percentiles are the timer percentiles in effect, derived from the
+	// config by configure().
+	percentiles []int
+
+	// lastFlush is the time of the previous submit() of each type, used to
+	// compute rates over the real elapsed interval.
+	lastFlush map[metricType]time.Time
+
+	// flushDuration is how long the previous submit() took, and
+	// graphiteWriteTime how long it spent writing to Graphite.
+	// graphiteErrors counts failed Graphite flushes since the last report.
+	flushDuration     time.Duration
+	graphiteWriteTime time.Duration
+	graphiteErrors    int64
+
+	// lastGraphiteData is the data last sent to Graphite, for the debug
+	// endpoint.
+	lastGraphiteData []byte
+
+	// firstSample is when the first packet since the last report of self
+	// metrics was aggregated, or zero if none has been.
+	firstSample time.Time
+
+	// cardinalityDropped counts packets for new buckets rejected because
+	// MaxBuckets was reached, since the last report.
+	cardinalityDropped int64
+
+	// backends are flushed to by submit(): those set up from the config by
+	// configure() followed by extraBackends, which were added by AddBackend.
+	backends      []Backend
+	extraBackends []Backend
+
+	// graphiteOverridden is set while the admin setgraphite command
+	// overrides the GraphiteAddresses from the config, which are kept in
+	// configGraphite so a reload only replaces the override if they change.
+	graphiteOverridden bool
+	configGraphite     []string
+
+	// Backend connections, nil when not configured. outputFile is held
+	// open across flushes and reopened if it is rotated away or a write to
+	// it fails.
+	graphite   []*connection
+	opentsdb   *connection
+	unixConn   *connection
+	outputFile *os.File
+	repeaters  []net.Conn
+
+	// stateRequests carries functions to be run on the monitor() goroutine.
+	stateRequests chan func()
+	stop          chan struct{}
+	done          chan struct{}
+
+	listenersMu sync.Mutex
+	listeners   []io.Closer
+
+	// datagrams carries packets from the datagram listeners, tracked by
+	// readers, to the pool of parsing goroutines, tracked by workers.
+	datagrams chan datagram
+	readers   sync.WaitGroup
+	workers   sync.WaitGroup
+
+	// udpPorts are the ports of the UDP listeners, bound by Start, and
+	// udpDrops the datagrams the kernel had dropped on them at the last
+	// report.
+	udpPorts []int
+	udpDrops int64
+
+	// packets holds reusable MaxPacketSize read buffers.
+	packets sync.Pool
+
+	health    healthState
+	startTime time.Time
+}
+
+// New returns a Server for config. Nothing is bound or dialed until Start.
+func New(config Config) (*Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Hostname: %s", err.Error())
+	}
+	s := &Server{
+		config:        config,
+		hostname:      hostname,
+		in:            make(chan Packet, 10000),
+		counters:      make(map[string]float64),
+		timers:        make(map[string][]float64),
+		gauges:        make(map[string]float64),
+		sets:          make(map[string]map[string]struct{}),
+		gaugeUpdated:  make(map[string]time.Time),
+		timerCounters: make(map[string]float64),
+		timerSeen:     make(map[string]int),
+		timerSeenSums: make(map[string][2]float64),
+		counterTotals: make(map[string]float64),
+		counterRates:  make(map[string]counterRate),
+		timerCounts:   make(map[string]float64),
+		timerSums:     make(map[string]float64),
+		lastTimers:    make(map[string][]float64),
+		lastFlush:     make(map[metricType]time.Time),
+		stateRequests: make(chan func()),
+		stop:          make(chan struct{}),
+		datagrams:     make(chan datagram, 1000),
+		done:          make(chan struct{}),
+	}
+	if config.PerSourceRateLimit > 0 {
+		s.limiter = newSourceLimiter(config.PerSourceRateLimit)
+	}
+	s.packets.New = func() interface{} {
+		message := make([]byte, config.MaxPacketSize)
+		return &message
+	}
+	return s, nil
+}
+
+// Start binds the configured listeners and starts aggregating and flushing
+// in the background. If any listener can't be bound, those already bound
+// are closed and the error is returned.
+func (s *Server) Start() error {
+	s.startTime = time.Now()
+	if err := s.dialRepeaters(s.config.RepeatAddresses); err != nil {
+		return err
+	}
+	listen := []struct {
+		address string
+		listen  func() error
+	}{
+		{s.config.Address, s.listenUDP},
+		{s.config.TCPAddress, s.listenTCP},
+		{s.config.UnixSocket, s.listenUnix},
+		{s.config.PrometheusAddress, s.listenPrometheus},
+		{s.config.AdminAddress, s.listenAdmin},
+		{s.config.HealthAddress, s.listenHealth},
+		{s.config.HTTPIngestAddress, s.listenHTTPIngest},
+		{s.config.DebugAddress, s.listenDebug},
+	}
+	workers := s.config.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	for i := 0; i < workers; i++ {
+		s.workers.Add(1)
+		go s.worker()
+	}
+	for _, l := range listen {
+		if l.address == "" {
+			continue
+		}
+		if err := l.listen(); err != nil {
+			s.stopListeners()
+			return err
+		}
+	}
+	if s.config.StateFile != "" {
+		if err := s.loadState(); err != nil {
+			log.Printf("Loading state from %s: %s", s.config.StateFile, err.Error())
+		}
+	}
+	s.configure()
+	go s.monitor()
+	return nil
+}
+
+// Stop closes the listeners, records anything still queued and performs a
+// final flush so no data is lost, then closes the backends. It must only
+// be called once, after Start.
+func (s *Server) Stop() {
+	s.stopListeners()
+	if s.config.UnixSocket != "" {
+		os.Remove(s.config.UnixSocket)
+	}
+	close(s.stop)
+	<-s.done
+}
+
+// Process parses a datagram as if a listener had received it and queues
+// its metrics for aggregation, so a server started with no listeners can
+// be fed directly. As for listeners, metrics are dropped if the queue is
+// full. It must only be called between Start and Stop.
+func (s *Server) Process(datagram []byte) {
+	s.handleMessage(nil, bytes.NewBuffer(datagram))
+}
+
+// ReadLines reads newline delimited metrics from r until it is exhausted
+// and queues them for aggregation. Unlike Process, it waits for room in
+// the queue rather than dropping metrics, so captured traffic can be
+// replayed in full. It must only be called between Start and Stop.
+func (s *Server) ReadLines(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text(), "", true)
+	}
+	return scanner.Err()
+}
+
+// Flush sends the current aggregates to the backends immediately rather
+// than waiting for the next flush interval.
+func (s *Server) Flush() {
+	s.withState(func() {
+		s.submit(allMetrics)
+	})
+}
+
+// Reload applies the settings in config which can be changed while running,
+// taking effect from the next flush. Changes to other settings are logged
+// and ignored.
+func (s *Server) Reload(config Config) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	s.withState(func() {
+		if s.graphiteOverridden {
+			if slices.Equal(config.GraphiteAddresses, s.configGraphite) {
+				config.GraphiteAddresses = s.config.GraphiteAddresses
+			} else {
+				log.Printf("Graphite addresses changed in the config, replacing %s set with setgraphite",
+					strings.Join(s.config.GraphiteAddresses, ","))
+				s.graphiteOverridden = false
+			}
+		}
+		current := reflect.ValueOf(&s.config).Elem()
+		next := reflect.ValueOf(config)
+		for i := 0; i < current.NumField(); i++ {
+			name := current.Type().Field(i).Name
+			if reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+				continue
+			}
+			if !reloadable[name] {
+				log.Printf("Setting %s can't be changed without a restart, skipping", name)
+				continue
+			}
+			current.Field(i).Set(next.Field(i))
+		}
+		s.configure()
+	})
+	return nil
+}
+
+func (s *Server) monitor() {
+	due := make(chan metricType)
+	// The jitter is chosen once, so flushes stay evenly spaced.
+	var jitter float64
+	if s.config.FlushJitter {
+		jitter = rand.Float64()
+	}
+	for interval, types := range s.config.flushGroups() {
+		offset := time.Duration(jitter * float64(interval))
+		go s.flushTicker(interval, offset, types, due)
+	}
+	start := time.Now()
+	for t := counterMetrics; t <= selfMetrics; t <<= 1 {
+		s.lastFlush[t] = start
+	}
+	for {
+		if s.config.Debug {
+			slog.Debug("tick")
+		}
+		select {
+		case types := <-due:
+			s.submit(types)
+		case f := <-s.stateRequests:
+			f()
+		case p := <-s.in:
+			s.processPacket(p)
+		case <-s.stop:
+			s.shutdown()
+			close(s.done)
+			return
+		}
+	}
+}
+
+// withState runs f on the monitor() goroutine, giving it exclusive access to
+// the aggregation maps, and waits for it to complete.
+func (s *Server) withState(f func()) {
+	done := make(chan struct{})
+	s.stateRequests <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// shutdown records anything still queued on in and performs a final flush.
+func (s *Server) shutdown() {
+	for {
+		select {
+		case p := <-s.in:
+			s.processPacket(p)
+		default:
+			s.submit(allMetrics)
+			if s.config.StateFile != "" {
+				if err := s.saveState(); err != nil {
+					log.Printf("Saving state to %s: %s", s.config.StateFile, err.Error())
+				}
+			}
+			s.closeBackends()
+			if s.outputFile != nil {
+				s.outputFile.Close()
+			}
+			return
+		}
+	}
+}
+
+// configure derives the settings used by submit() from the config. It is
+// called at startup and again whenever the config is reloaded.
+func (s *Server) configure() {
+	s.percentiles = s.config.Percentiles
+	if len(s.percentiles) == 0 {
+		s.percentiles = []int{s.config.PercentThreshold}
+	}
+	s.configureBackends()
+}
+
+// configureBackends sets up the backends from the config.
+func (s *Server) configureBackends() {
+	// Connections to backends whose address hasn't changed are kept, so
+	// flushes queued during an outage survive a reload.
+	old := make(map[string]*connection)
+	for _, c := range s.graphite {
+		old[c.name] = c
+	}
+	if s.opentsdb != nil {
+		old[s.opentsdb.name] = s.opentsdb
+	}
+	if s.unixConn != nil {
+		old[s.unixConn.name] = s.unixConn
+	}
+	reuse := func(name, address string) *connection {
+		if c, ok := old[name]; ok && c.address == address {
+			delete(old, name)
+			return c
+		}
+		return newConnection(name, address, s.config.Debug)
+	}
+
+	s.backends = nil
+	s.graphite = nil
+	// The config has already been validated, so this can only fail if the
+	// certificate files changed since.
+	tlsConfig, err := s.config.graphiteTLSConfig()
+	if err != nil {
+		log.Println(err)
+	}
+	for _, address := range s.config.GraphiteAddresses {
+		if s.config.GraphiteUDP {
+			s.backends = append(s.backends, &graphiteUDPBackend{s, address})
+			continue
+		}
+		c := reuse("graphite "+address, address)
+		c.setTLSConfig(tlsConfig)
+		c.maxWrite = s.config.MaxFlushBytes
+		c.maxPending = s.config.GraphiteQueueSize
+		s.graphite = append(s.graphite, c)
+		s.backends = append(s.backends, &graphiteBackend{s, c, false})
+	}
+	if address := s.config.PickleAddress; address != "" {
+		c := reuse("graphite pickle "+address, address)
+		c.setTLSConfig(tlsConfig)
+		c.maxPending = s.config.GraphiteQueueSize
+		s.graphite = append(s.graphite, c)
+		s.backends = append(s.backends, &graphiteBackend{s, c, true})
+	}
+	if s.config.Stdout {
+		s.backends = append(s.backends, &stdoutBackend{s})
+	}
+	if s.config.OutputFile != "" {
+		s.backends = append(s.backends, &fileBackend{s})
+	}
+	s.opentsdb = nil
+	if address := s.config.OpenTSDBAddress; address != "" {
+		s.opentsdb = reuse("opentsdb "+address, address)
+		s.opentsdb.maxWrite = s.config.MaxFlushBytes
+		s.backends = append(s.backends, &openTSDBBackend{s, s.opentsdb})
+	}
+	if s.config.InfluxDBAddress != "" {
+		s.backends = append(s.backends, &influxDBBackend{s})
+	}
+	s.unixConn = nil
+	if path := s.config.BackendUnixSocket; path != "" {
+		s.unixConn = reuse("unix socket "+path, path)
+		s.unixConn.network = "unix"
+		s.backends = append(s.backends, &unixSocketBackend{s, s.unixConn})
+	}
+	s.backends = append(s.backends, s.extraBackends...)
+
+	for _, c := range old {
+		c.Close()
+	}
+}
+
+// closeBackends closes any open backend connections.
+func (s *Server) closeBackends() {
+	for _, c := range s.graphite {
+		c.Close()
+	}
+	if s.opentsdb != nil {
+		s.opentsdb.Close()
+	}
+	if s.unixConn != nil {
+		s.unixConn.Close()
+	}
+}
+
+// processPacket records a single parsed packet in the aggregation maps.
+// bucketExists reports whether key is already being aggregated as the type
+// of metric given by modifier.
+func (s *Server) bucketExists(key, modifier string) bool {
+	var ok bool
+	switch modifier {
+	case "ms":
+		_, ok = s.timers[key]
+	case "g":
+		_, ok = s.gauges[key]
+	case "s":
+		_, ok = s.sets[key]
+	default:
+		_, ok = s.counters[key]
+	}
+	return ok
+}
+
+func (s *Server) processPacket(p Packet) {
+	if len(s.config.Renames) > 0 {
+		for _, r := range s.config.Renames {
+			p.Bucket = r.Pattern.ReplaceAllString(p.Bucket, r.Replacement)
+		}
+		p.Bucket = sanitizeRegexp.ReplaceAllString(p.Bucket, "")
+		if p.Bucket == "" {
+			return
+		}
+	}
+	if s.firstSample.IsZero() {
+		s.firstSample = time.Now()
+	}
+	key := bucketKey(p.Bucket, p.Tags)
+	if p.Modifier == "kv" {
+		// Key/value events aren't aggregated, so don't count as buckets.
+		floatValue, _ := strconv.ParseFloat(p.Value, 64)
+		s.keyValues = append(s.keyValues, KeyValue{key, floatValue, time.Now()})
+		return
+	}
+	if s.config.MaxBuckets > 0 && !s.bucketExists(key, p.Modifier) &&
+		len(s.counters)+len(s.timers)+len(s.gauges)+len(s.sets) >= s.config.MaxBuckets {
+		s.cardinalityDropped++
+		return
+	}
+	if p.Modifier == "ms" {
+		_, ok := s.timers[key]
+		if !ok {
+			var t []float64
+			s.timers[key] = t
+		}
+		//intValue, _ := strconv.Atoi(p.Value)
+		floatValue, _ := strconv.ParseFloat(p.Value, 64)
+		if s.config.TimerUnitScale != 0 {
+			floatValue *= s.config.TimerUnitScale
+		}
+		// Beyond MaxTimerSamples, reservoir sampling keeps a uniformly
+		// random subset of the samples received this interval.
+		s.timerSeen[key]++
+		sums := s.timerSeenSums[key]
+		s.timerSeenSums[key] = [2]float64{sums[0] + floatValue, sums[1] + floatValue*floatValue}
+		if limit := s.config.MaxTimerSamples; limit <= 0 || len(s.timers[key]) < limit {
+			s.timers[key] = append(s.timers[key], floatValue)
+		} else if i := rand.IntN(s.timerSeen[key]); i < limit {
+			s.timers[key][i] = floatValue
+		}
+		s.timerCounters[key] += 1 / float64(p.Sampling)
+		s.timerCounts[key] += 1 / float64(p.Sampling)
+		s.timerSums[key] += floatValue / float64(p.Sampling)
+	} else if p.Modifier == "g" {
+		if p.Value == "delete" {
+			delete(s.gauges, key)
+			delete(s.gaugeUpdated, key)
+			return
+		}
+		_, ok := s.gauges[key]
+		if !ok {
+			s.gauges[key] = 0
+		}
+		s.gaugeUpdated[key] = time.Now()
+		// A leading sign makes the value a delta; otherwise it replaces
+		// the gauge, which keeps its value across flushes until then.
+		scale := 1.0
+		if s.config.SampleGaugeDeltas {
+			scale = 1 / float64(p.Sampling)
+		}
+		if strings.HasPrefix(p.Value, "+") {
+			floatValue, _ := strconv.ParseFloat(p.Value[1:], 64)
+			s.gauges[key] += floatValue * scale
+		} else if strings.HasPrefix(p.Value, "-") {
+			floatValue, _ := strconv.ParseFloat(p.Value[1:], 64)
+			s.gauges[key] -= floatValue * scale
+			if s.config.GaugeNoNegative && s.gauges[key] < 0 {
+				s.gauges[key] = 0
+			}
+		} else {
+			floatValue, _ := strconv.ParseFloat(p.Value, 64)
+			s.gauges[key] = floatValue
+		}
+	} else if p.Modifier == "s" {
+		_, ok := s.sets[key]
+		if !ok {
+			s.sets[key] = make(map[string]struct{})
+		}
+		s.sets[key][p.Value] = struct{}{}
+	} else {
+		_, ok := s.counters[key]
+		if !ok {
+			s.counters[key] = 0
+		}
+		// A negative value decrements the counter. As in reference
+		// statsd, it is scaled by the sample rate like any other value.
+		floatValue, _ := strconv.ParseFloat(p.Value, 64)
+		increment := floatValue / float64(p.Sampling)
+		s.counters[key] += increment
+		s.counterTotals[key] += increment
+	}
+}
@@ -0,0 +1,259 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+)
+
+// captureBackend records the snapshots it is flushed.
+type captureBackend struct {
+	snapshots []MetricSnapshot
+}
+
+func (b *captureBackend) Flush(m MetricSnapshot) error {
+	b.snapshots = append(b.snapshots, m)
+	return nil
+}
+
+// newTestServer returns a server for config which isn't started, so the
+// test can drive it from its own goroutine in place of monitor(), flushing
+// to the returned backend.
+func newTestServer(t *testing.T, config Config) (*Server, *captureBackend) {
+	t.Helper()
+	config.Address = ""
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &captureBackend{}
+	s.AddBackend(b)
+	s.configure()
+	return s, b
+}
+
+// process parses lines and aggregates the resulting packets.
+func process(s *Server, lines ...string) {
+	for _, line := range lines {
+		s.handleLine(line, "", false)
+	}
+	for len(s.in) > 0 {
+		s.processPacket(<-s.in)
+	}
+}
+
+// flush submits every type of metric and returns the snapshot.
+func flush(s *Server, b *captureBackend) MetricSnapshot {
+	s.submit(allMetrics)
+	return b.snapshots[len(b.snapshots)-1]
+}
+
+// timerStat returns the named statistic from stats, failing the test if
+// there is none.
+func timerStat(t *testing.T, stats []TimerStat, name string) float64 {
+	t.Helper()
+	for _, stat := range stats {
+		if stat.Name == name {
+			return stat.Value
+		}
+	}
+	t.Fatalf("no %s statistic in %v", name, stats)
+	return 0
+}
+
+// nopBackend discards every flush.
+type nopBackend struct{}
+
+func (nopBackend) Flush(m MetricSnapshot) error { return nil }
+
+// BenchmarkPipeline measures metrics through parsing, aggregation on the
+// monitor goroutine and flushing, with no sockets involved.
+func BenchmarkPipeline(b *testing.B) {
+	config := DefaultConfig()
+	config.Address = ""
+	s, err := New(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s.AddBackend(nopBackend{})
+	if err := s.Start(); err != nil {
+		b.Fatal(err)
+	}
+	datagram := []byte("api.requests:1|c\napi.time:320|ms|@0.5\nqueue.depth:+3|g\nusers:alice|s\n" +
+		"api.errors:1|c|#env:prod\napi.time:1:2:3|ms\nqueue.depth:-1|g\nusers:bob|s")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(datagram)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// ReadLines waits for room in the queue, so nothing is dropped.
+		if err := s.ReadLines(bytes.NewReader(datagram)); err != nil {
+			b.Fatal(err)
+		}
+		if i%1000 == 999 {
+			s.Flush()
+		}
+	}
+	s.Stop()
+}
+
+// TestCounterIncrementsAndDecrements checks mixed sequences against the
+// values reference statsd flushes, where each value is divided by its
+// sample rate and summed.
+func TestCounterIncrementsAndDecrements(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  float64
+	}{
+		{[]string{"foo:5|c", "foo:-3|c"}, 2},
+		{[]string{"foo:-1|c|@0.5"}, -2},
+		{[]string{"foo:1|c", "foo:-1|c", "foo:-1|c"}, -1},
+		{[]string{"foo:10|c|@0.25", "foo:-5|c"}, 35},
+		{[]string{"foo:-2|c", "foo:+3|c"}, 1},
+	}
+	for _, tt := range tests {
+		s, b := newTestServer(t, DefaultConfig())
+		process(s, tt.lines...)
+		if got := flush(s, b).Counters["foo"]; got != tt.want {
+			t.Errorf("%q flushed %v, want %v", tt.lines, got, tt.want)
+		}
+	}
+}
+
+func TestTimerCountScaledBySampleRate(t *testing.T) {
+	s, b := newTestServer(t, DefaultConfig())
+	process(s, "req:320|ms|@0.1")
+	m := flush(s, b)
+	if got := timerStat(t, m.TimerStats["req"], "count"); math.Abs(got-10) > 1e-4 {
+		t.Errorf("count = %v, want 10", got)
+	}
+}
+
+func TestGaugeKeptAcrossFlushes(t *testing.T) {
+	s, b := newTestServer(t, DefaultConfig())
+	process(s, "queue:72|g")
+	if got := flush(s, b).Gauges["queue"]; got != 72 {
+		t.Errorf("first flush sent %v, want 72", got)
+	}
+	// No update in between, so the gauge keeps its value.
+	if got, ok := flush(s, b).Gauges["queue"]; !ok || got != 72 {
+		t.Errorf("second flush sent %v (present %t), want 72", got, ok)
+	}
+}
+
+// TestReloadWhileProcessing reloads the config while datagrams are being
+// parsed, for the race detector to check that parsing only reads settings
+// Reload leaves alone.
+func TestReloadWhileProcessing(t *testing.T) {
+	config := DefaultConfig()
+	config.Address = ""
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			s.Process([]byte("foo:1|c\nbar:2|ms\nbaz:3|g"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		next := config
+		next.CountersPrefix = fmt.Sprintf("stats.counters%d.", i)
+		if err := s.Reload(next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	s.Stop()
+}
+
+// unusedAddress returns a local TCP address nothing is listening on.
+func unusedAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestConfigureKeepsQueuedFlushes(t *testing.T) {
+	config := DefaultConfig()
+	config.GraphiteAddresses = []string{unusedAddress(t)}
+	config.GraphiteQueueSize = 5
+	s, b := newTestServer(t, config)
+	flush(s, b)
+	flush(s, b)
+	c := s.graphite[0]
+	if len(c.pending) != 2 {
+		t.Fatalf("%d flushes queued, want 2", len(c.pending))
+	}
+
+	// A reload which leaves the Graphite address alone keeps the queue.
+	s.config.CountersPrefix = "counters."
+	s.configure()
+	if s.graphite[0] != c || len(c.pending) != 2 {
+		t.Errorf("%d flushes queued after configure, want 2", len(s.graphite[0].pending))
+	}
+
+	s.config.GraphiteAddresses = []string{unusedAddress(t)}
+	s.configure()
+	if s.graphite[0] == c {
+		t.Error("connection kept after its address changed")
+	}
+}
+
+func TestSetGraphiteSurvivesReload(t *testing.T) {
+	config := DefaultConfig()
+	config.Address = ""
+	config.GraphiteAddresses = []string{unusedAddress(t)}
+	config.OpenTSDBAddress = unusedAddress(t)
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	state := func() (graphite string, opentsdb *connection) {
+		s.withState(func() {
+			graphite, opentsdb = s.graphite[0].address, s.opentsdb
+		})
+		return graphite, opentsdb
+	}
+
+	_, opentsdb := state()
+	failover := unusedAddress(t)
+	s.withState(func() { s.adminCommand("setgraphite", []string{failover}) })
+	if graphite, c := state(); graphite != failover || c != opentsdb {
+		t.Fatalf("after setgraphite: graphite %s, opentsdb kept %t, want %s and true", graphite, c == opentsdb, failover)
+	}
+
+	// A reload which doesn't touch the Graphite addresses keeps the
+	// override.
+	next := config
+	next.CountersPrefix = "counters."
+	if err := s.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if graphite, _ := state(); graphite != failover {
+		t.Errorf("after reload: graphite %s, want %s", graphite, failover)
+	}
+
+	// One which changes them replaces it.
+	next.GraphiteAddresses = []string{unusedAddress(t)}
+	if err := s.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if graphite, _ := state(); graphite != next.GraphiteAddresses[0] {
+		t.Errorf("after changing the config: graphite %s, want %s", graphite, next.GraphiteAddresses[0])
+	}
+}
@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedState is the aggregation state written to StateFile. It is saved
+// after the final flush, so it holds what would have carried over to the
+// next interval: gauge values, counter totals if CountersCumulative is set,
+// and the buckets which would otherwise report zeros. Counter rates are
+// kept too, so a running total isn't taken as a single increment after a
+// restart.
+type savedState struct {
+	Counters     map[string]float64   `json:"counters"`
+	Gauges       map[string]float64   `json:"gauges"`
+	Timers       map[string][]float64 `json:"timers"`
+	CounterRates map[string]savedRate `json:"counter_rates,omitempty"`
+}
+
+// savedRate is the saved form of a counterRate.
+type savedRate struct {
+	Rates [3]float64 `json:"rates"`
+	Total float64    `json:"total"`
+}
+
+// saveState writes the aggregation state to StateFile, replacing the old
+// file only once the new one is complete.
+func (s *Server) saveState() error {
+	rates := make(map[string]savedRate, len(s.counterRates))
+	for key, r := range s.counterRates {
+		rates[key] = savedRate{r.rates, r.total}
+	}
+	data, err := json.Marshal(savedState{s.counters, s.gauges, s.timers, rates})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.config.StateFile), filepath.Base(s.config.StateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.config.StateFile)
+}
+
+// loadState restores the aggregation state saved by a previous run. A
+// missing file is not an error, since there won't be one on the first run.
+func (s *Server) loadState() error {
+	data, err := os.ReadFile(s.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	now := time.Now()
+	for key, c := range state.Counters {
+		s.counters[key] = c
+	}
+	for key, r := range state.CounterRates {
+		s.counterRates[key] = counterRate{rates: r.Rates, total: r.Total}
+	}
+	for key, g := range state.Gauges {
+		s.gauges[key] = g
+		s.gaugeUpdated[key] = now
+	}
+	for key, t := range state.Timers {
+		s.timers[key] = t
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// udpTables are the Linux tables of UDP sockets, whose last column counts
+// the datagrams each socket dropped because its receive buffer was full.
+var udpTables = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// udpReceiveDrops returns the total number of datagrams dropped by the
+// kernel on the UDP sockets bound to any of ports. It fails where the
+// tables aren't available, such as on systems other than Linux.
+func udpReceiveDrops(ports []int) (int64, error) {
+	var total int64
+	read := 0
+	for _, table := range udpTables {
+		f, err := os.Open(table)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		read++
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 13 {
+				continue
+			}
+			// The local address is hex IP:hex port.
+			i := strings.LastIndexByte(fields[1], ':')
+			port, err := strconv.ParseInt(fields[1][i+1:], 16, 32)
+			if err != nil || !containsPort(ports, int(port)) {
+				continue
+			}
+			drops, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			if err == nil {
+				total += drops
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if read == 0 {
+		return 0, os.ErrNotExist
+	}
+	return total, nil
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}